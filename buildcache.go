@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Build steps are cached by a hash of their inputs: the staged source
+// files, the prepared source tree (including distribution specific patches
+// and the substituted changelog), the build options, the configuration of
+// the distribution and the installed packages of the build environment. The
+// results of successful steps are kept in cache/<hash>/ and reused when a
+// step with the same inputs is built again, unless the package was staged
+// with --force.
+const buildCacheVersion = 1
+
+type cachedBuild struct {
+	Files   []string
+	Changes string         `json:",omitempty"`
+	Lintian *LintianResult `json:",omitempty"`
+	Test    *TestResult    `json:",omitempty"`
+	Created time.Time
+
+	Reproducible *ReproducibleResult `json:",omitempty"`
+}
+
+func buildCacheDir(key string) string {
+	return path.Join(options.Base, "cache", key)
+}
+
+func hashFile(h hash.Hash, filename string) error {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fmt.Fprintf(h, "file %s\n", path.Base(filename))
+	_, err = io.Copy(h, f)
+
+	return err
+}
+
+// hashTree hashes the names, modes and contents of all files in dir.
+// Symbolic links are followed, so that linked original tarballs are hashed
+// by their content.
+func hashTree(h hash.Hash, dir string) error {
+	names := make([]string, 0)
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		names = append(names, p)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fi, err := os.Stat(name)
+
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, name)
+		fmt.Fprintf(h, "%s %o\n", rel, fi.Mode())
+
+		if fi.Mode().IsRegular() {
+			if err := hashFile(h, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// chrootIdentity hashes the package database of the build environment of
+// a distribution architecture, which changes whenever the environment is
+// updated.
+func chrootIdentity(h hash.Hash, distro *Distribution, arch string) error {
+	arch, err := chrootArchitecture(distro, arch)
+
+	if err != nil {
+		return err
+	}
+
+	status := path.Join(options.Base,
+		"pbuilder",
+		distro.Os,
+		fmt.Sprintf("%s-%s", distro.CodeName, arch),
+		"base.cow",
+		"var",
+		"lib",
+		"dpkg",
+		"status")
+
+	return hashFile(h, status)
+}
+
+func (x *PackageBuilder) computeBuildCacheKey(binfo *BuildInfo, distro *Distribution, arch string, localrepo string, extra ...string) (string, error) {
+	pack := binfo.Package
+	h := sha256.New()
+
+	fmt.Fprintf(h, "autobuild %v\n%s/%s/%s\n", buildCacheVersion, distro.Os, distro.CodeName, arch)
+
+	for _, e := range extra {
+		fmt.Fprintf(h, "%s\n", e)
+	}
+
+	// Staged source files
+	inputs := []string{pack.OrigGz, pack.DiffGz, pack.Dsc}
+
+	if len(pack.Dsc) != 0 {
+		for _, name := range binfo.Info.Files {
+			inputs = append(inputs, path.Join(binfo.Info.StageFilesDir(), name))
+		}
+	}
+
+	if patch, ok := pack.Patches[distro.CodeName]; ok {
+		inputs = append(inputs, patch)
+	}
+
+	for _, input := range inputs {
+		if len(input) == 0 {
+			continue
+		}
+
+		if err := hashFile(h, input); err != nil {
+			return "", err
+		}
+	}
+
+	// Options of the package and the configured distribution
+	opts, err := json.Marshal(&pack.Options)
+
+	if err != nil {
+		return "", err
+	}
+
+	h.Write(opts)
+
+	if cfg := options.BuildOptions.FindDistribution(distro); cfg != nil {
+		if data, err := json.Marshal(cfg); err == nil {
+			h.Write(data)
+		}
+	}
+
+	// The prepared source tree
+	if err := hashTree(h, binfo.buildDir(distro, arch)); err != nil {
+		return "", err
+	}
+
+	if len(localrepo) != 0 {
+		if err := hashTree(h, localrepo); err != nil {
+			return "", err
+		}
+	}
+
+	if err := chrootIdentity(h, distro, arch); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildCacheKey returns the cache key of a build step, or an empty string if
+// the step cannot be cached.
+func (x *PackageBuilder) buildCacheKey(binfo *BuildInfo, info *DistroBuildInfo, distro *Distribution, arch string, localrepo string, extra ...string) string {
+	key, err := x.computeBuildCacheKey(binfo, distro, arch, localrepo, extra...)
+
+	if err != nil {
+		fmt.Fprintf(info.output, "Not using the build cache: %s\n", err)
+		return ""
+	}
+
+	return key
+}
+
+// reuseCachedBuild moves the cached results of a build step with the same
+// inputs to incoming. It returns false if there are no cached results, or
+// if the package was staged with --force.
+func (x *PackageBuilder) reuseCachedBuild(binfo *BuildInfo, info *DistroBuildInfo, key string) bool {
+	if len(key) == 0 || binfo.Info.Force {
+		return false
+	}
+
+	dir := buildCacheDir(key)
+	data, err := ioutil.ReadFile(path.Join(dir, "cache.json"))
+
+	if err != nil {
+		return false
+	}
+
+	var cached cachedBuild
+
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return false
+	}
+
+	os.MkdirAll(info.IncomingDir, 0755)
+
+	files := make([]string, 0, len(cached.Files))
+
+	for _, name := range cached.Files {
+		target := path.Join(info.IncomingDir, name)
+
+		if err := LinkFile(path.Join(dir, name), target); err != nil {
+			fmt.Fprintf(info.output, "Failed to reuse cached build result `%s': %s\n", name, err)
+			return false
+		}
+
+		x.chownToUser(target, binfo)
+		files = append(files, target)
+	}
+
+	info.Files = files
+	info.Lintian = cached.Lintian
+
+	// The limits of the daemon configuration may have changed
+	if info.Lintian != nil {
+		info.Lintian.check(options.BuildOptions.Lintian.restrict(&binfo.Package.Options.Lintian))
+	}
+	info.Test = cached.Test
+	info.Reproducible = cached.Reproducible
+	info.Cached = key
+
+	if len(cached.Changes) != 0 {
+		info.Changes = path.Join(info.IncomingDir, cached.Changes)
+
+		if err := x.parseChanges(info); err != nil {
+			fmt.Fprintf(info.output, "Failed to parse cached changes file `%s': %s\n", cached.Changes+".changes", err)
+
+			info.Files = nil
+			info.Changes = ""
+			info.Lintian = nil
+			info.Test = nil
+			info.Reproducible = nil
+			info.Cached = ""
+
+			return false
+		}
+	}
+
+	fmt.Fprintf(info.output, "Reusing the results of a previous build with identical inputs (built %s, cache %s)\n",
+		cached.Created.Format(time.RFC1123),
+		key)
+
+	for _, name := range cached.Files {
+		fmt.Fprintf(info.output, "  %s\n", name)
+	}
+
+	return true
+}
+
+// storeCachedBuild stores the results of a successful build step in the
+// build cache.
+func (x *PackageBuilder) storeCachedBuild(info *DistroBuildInfo, key string) {
+	if len(key) == 0 || info.Error != nil {
+		return
+	}
+
+	dir := buildCacheDir(key)
+	tmpdir := dir + ".tmp"
+
+	os.RemoveAll(tmpdir)
+	os.MkdirAll(tmpdir, 0755)
+
+	cached := cachedBuild{
+		Files:   make([]string, 0, len(info.Files)),
+		Lintian: info.Lintian,
+		Test:    info.Test,
+		Created: time.Now(),
+
+		Reproducible: info.Reproducible,
+	}
+
+	if len(info.Changes) != 0 {
+		cached.Changes = path.Base(info.Changes)
+	}
+
+	err := func() error {
+		for _, f := range info.Files {
+			if err := LinkFile(f, path.Join(tmpdir, path.Base(f))); err != nil {
+				return err
+			}
+
+			cached.Files = append(cached.Files, path.Base(f))
+		}
+
+		data, err := json.Marshal(&cached)
+
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path.Join(tmpdir, "cache.json"), data, 0644); err != nil {
+			return err
+		}
+
+		os.RemoveAll(dir)
+		return os.Rename(tmpdir, dir)
+	}()
+
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		fmt.Fprintf(os.Stderr, "Failed to store build results in the build cache: %s\n", err)
+	}
+}
+
+// readChangelogVersion reads the name and version of the top entry of a
+// debian/changelog.
+func readChangelogVersion(changelog string) (*ChangelogHeader, error) {
+	f, err := os.Open(changelog)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ReadChangelogHeader(f)
+}
+
+// checkPublishedSource returns whether the exact version of the prepared
+// source is already published in the distribution, in which case the
+// published version is recorded on the build instead of building it again.
+// It returns false if the package was staged with --force.
+func (x *PackageBuilder) checkPublishedSource(binfo *BuildInfo, info *DistroBuildInfo, distro *Distribution) bool {
+	if binfo.Info.Force {
+		return false
+	}
+
+	header, err := readChangelogVersion(path.Join(binfo.sourceDir(distro, "source"), "debian", "changelog"))
+
+	if err != nil {
+		return false
+	}
+
+	published, err := publishedVersion(distro, header.Name)
+
+	if err != nil || published == nil || published.Compare(header.Version) != 0 {
+		return false
+	}
+
+	info.Published = published.String()
+
+	fmt.Fprintf(info.output, "The source package %s %s is already published in %s and is not built again (stage with --force to build it anyway)\n",
+		header.Name,
+		header.Version,
+		distro.SourceName())
+
+	return true
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"compress/gzip"
 	"encoding/gob"
 	"encoding/json"
@@ -10,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"regexp"
@@ -18,6 +18,8 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Error string
@@ -55,6 +57,9 @@ func (x *Error) GobDecode(bytes []byte) error {
 	return nil
 }
 
+var ErrBuildCancelled = Error("The build was cancelled")
+var ErrBuildSkipped = Error("The build was skipped because another build of the package failed")
+
 type DistroBuildInfo struct {
 	IncomingDir  string
 	Changes      string
@@ -62,8 +67,22 @@ type DistroBuildInfo struct {
 	ChangesFiles []string
 	Files        []string
 	Error        error
+	TimedOut     bool
+	Retries      int
+	Lintian      *LintianResult
+	Test         *TestResult
+	Reproducible *ReproducibleResult
+	Environment  *BuildEnvironment
+	Cached       string `json:",omitempty"`
+	Published    string `json:",omitempty"`
+	Started      time.Time
+	Finished     time.Time
 	Log          string `json:"-"`
+	LogFile      string `json:"-"`
 	Id           uint64
+
+	output *BuildLog
+	envdir string
 }
 
 type DistroBuildInfoMap map[uint64]*DistroBuildInfo
@@ -75,11 +94,25 @@ type BuildInfo struct {
 	BuildResultsDir string
 	Error           error
 
+	Started  time.Time
+	Finished time.Time
+
 	Source   map[string]*DistroBuildInfo
 	Binaries map[string]*DistroBuildInfo
 	Packages DistroBuildInfoMap
+
+	// The number of times the build of a distribution architecture (e.g.
+	// ubuntu/precise/amd64) was retried
+	Retries map[string]int
+
+	pending   int
+	cancelled bool
+	commands  map[*exec.Cmd]bool
+	steps     map[uint64]*DistroBuildInfo
 }
 
+type PackageInfoMap map[uint64]*PackageInfo
+
 func (x DistroBuildInfoMap) MarshalJSON() ([]byte, error) {
 	rm := make(map[string]*DistroBuildInfo)
 
@@ -90,6 +123,44 @@ func (x DistroBuildInfoMap) MarshalJSON() ([]byte, error) {
 	return json.Marshal(rm)
 }
 
+func (x PackageInfoMap) MarshalJSON() ([]byte, error) {
+	rm := make(map[string]*PackageInfo)
+
+	for k, v := range x {
+		rm[fmt.Sprintf("%v", k)] = v
+	}
+
+	return json.Marshal(rm)
+}
+
+func (x PackageInfoMap) Contains(pname string) bool {
+	for _, info := range x {
+		if info.MatchStageFile(pname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (x PackageInfoMap) Sorted() []*PackageInfo {
+	ids := make(Uint64Slice, 0, len(x))
+
+	for id, _ := range x {
+		ids = append(ids, id)
+	}
+
+	ids.Sort()
+
+	ret := make([]*PackageInfo, len(ids))
+
+	for i, id := range ids {
+		ret[i] = x[id]
+	}
+
+	return ret
+}
+
 func (x DistroBuildInfoMap) UnmarshalJSON(data []byte) error {
 	rm := make(map[string]*DistroBuildInfo)
 
@@ -110,16 +181,43 @@ func (x DistroBuildInfoMap) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func (x *BuildInfo) buildDir(distro *Distribution, arch string) string {
+	return path.Join(x.Package.Dir, "build", distro.Os, distro.CodeName, arch)
+}
+
+func (x *BuildInfo) sourceDir(distro *Distribution, arch string) string {
+	return path.Join(x.buildDir(distro, arch), fmt.Sprintf("%s-%s", x.Info.Name, x.Info.Version))
+}
+
+func (x *BuildInfo) resultsDir(distro *Distribution, arch string) string {
+	return path.Join(x.BuildResultsDir, distro.Os, distro.CodeName, arch)
+}
+
+// finishedStep returns the build step of a distribution architecture which
+// has already finished, or nil if it has not been built yet.
+func (x *BuildInfo) finishedStep(distro *Distribution, arch string) *DistroBuildInfo {
+	for _, info := range x.Packages {
+		d := info.Distribution
+
+		if d.Os == distro.Os && d.CodeName == distro.CodeName && len(d.Architectures) == 1 && d.Architectures[0] == arch {
+			return info
+		}
+	}
+
+	return nil
+}
+
 type ExtractedPackage struct {
 	Dir     string
 	OrigGz  string
 	DiffGz  string
+	Dsc     string
 	Patches map[string]string
 	Options BuildOptions
 }
 
 type PackageBuilder struct {
-	CurrentlyBuilding *PackageInfo
+	CurrentlyBuilding PackageInfoMap
 	FinishedPackages  []*BuildInfo
 	PackageQueue      []*PackageInfo
 
@@ -127,17 +225,43 @@ type PackageBuilder struct {
 
 	notifyQueue chan bool
 
+	Policy SchedulePolicy
+
+	served      map[uint32]uint64
+	servedCount uint64
+
+	building      map[uint64]*BuildInfo
+	jobs          []*buildJob
+	running       int
+	runningLimits map[string]int
+
+	// Packages which were building when the builder was stopped, by
+	// package id
+	resumable map[uint64]*BuildInfo
+
+	// Stage files which are written but not yet queued
+	staging map[string]bool
+
+	journalSequence uint64
+	journalEntries  int
+
 	Mutex     sync.Mutex
 	PackageId uint64
 }
 
 var builder = PackageBuilder{
-	BuildInfoMap: make(map[uint64]*BuildInfo),
-	notifyQueue:  make(chan bool, 1024),
+	CurrentlyBuilding: make(PackageInfoMap),
+	BuildInfoMap:      make(map[uint64]*BuildInfo),
+	notifyQueue:       make(chan bool, 1024),
+	Policy:            SchedulePolicyFair,
+	served:            make(map[uint32]uint64),
+	building:          make(map[uint64]*BuildInfo),
+	runningLimits:     make(map[string]int),
+	resumable:         make(map[uint64]*BuildInfo),
+	staging:           make(map[string]bool),
 }
 
 var packageInfoRegex *regexp.Regexp
-var changelogSubstituteRegex *regexp.Regexp
 
 func (x *PackageBuilder) Do(fn func(b *PackageBuilder) error) error {
 	x.Mutex.Lock()
@@ -147,14 +271,139 @@ func (x *PackageBuilder) Do(fn func(b *PackageBuilder) error) error {
 	return err
 }
 
+func (x *PackageBuilder) writeStageFile(filename string, uid uint32, fn func(writer io.Writer) error) error {
+	f, err := os.Create(filename)
+
+	if err != nil {
+		return err
+	}
+
+	if err := fn(f); err != nil {
+		f.Close()
+		os.Remove(filename)
+
+		return err
+	}
+
+	f.Close()
+
+	// The owner of the staged file is used to recover the queue
+	// when the builder state is lost
+	os.Chown(filename, int(uid), -1)
+	return nil
+}
+
+// stageDscFiles stages the files referenced by a source package (.dsc) and
+// verifies their checksums.
+func (x *PackageBuilder) stageDscFiles(info *PackageInfo, files []string, fn func(x *PackageBuilder, name string, writer io.Writer) error) error {
+	available := make(map[string]bool)
+
+	for _, name := range files {
+		available[name] = true
+	}
+
+	dir := info.StageFilesDir()
+
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+
+	for _, name := range info.Files {
+		if !available[name] || name != path.Base(name) {
+			return fmt.Errorf("The file `%s' referenced by `%s' was not staged", name, path.Base(info.StageFile))
+		}
+
+		err := x.writeStageFile(path.Join(dir, name), info.Uid, func(writer io.Writer) error {
+			return fn(x, name, writer)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	dsc, err := ParseDscFile(info.StageFile)
+
+	if err != nil {
+		return err
+	}
+
+	return dsc.Verify(dir)
+}
+
+// checkPublishedVersion refuses packages with a version which is not newer
+// than the version already published in one of the distributions. The
+// version which is built is read from the top entry of debian/changelog,
+// which gets the version suffix of the distribution when it is UNRELEASED.
+// When debian/changelog cannot be read, the version of the staged package
+// is used.
+func (x *PackageBuilder) checkPublishedVersion(info *PackageInfo, distros []*Distribution) error {
+	header, err := info.ReadChangelogHeader()
+
+	if err != nil {
+		version, err := info.DebianVersion()
+
+		if err != nil {
+			return err
+		}
+
+		header = &ChangelogHeader{Name: info.Name, Version: version}
+	}
+
+	for _, distro := range distros {
+		published, err := publishedVersion(distro, info.Name)
+
+		// Nothing published yet, or no repository for the distribution
+		if err != nil || published == nil {
+			continue
+		}
+
+		if header.Distribution == "UNRELEASED" {
+			// Use the configured version suffix of the distribution
+			cfg := distro
+
+			if c := options.BuildOptions.FindDistribution(distro); c != nil {
+				cfg = c
+			}
+
+			if _, err := suffixedVersion(header.Version, published, cfg); err != nil {
+				return fmt.Errorf("The version %s of `%s' is not newer than the version %s published in %s",
+					header.Version, info.Name, published, distro.SourceName())
+			}
+		} else if header.Version.Compare(published) <= 0 {
+			return fmt.Errorf("The version %s of `%s' is not newer than the version %s published in %s",
+				header.Version, info.Name, published, distro.SourceName())
+		}
+	}
+
+	return nil
+}
+
+// Stage queues the package pname to be built. The contents of the package,
+// and of any additional files (such as the files referenced by a .dsc),
+// are written by fn.
 func (x *PackageBuilder) Stage(pname string,
+	files []string,
 	uid uint32,
-	fn func(x *PackageBuilder, writer io.Writer) error) (*PackageInfo, error) {
+	priority int,
+	distributions []string,
+	force bool,
+	fn func(x *PackageBuilder, name string, writer io.Writer) error) (*PackageInfo, error) {
 	var info *PackageInfo
 
-	return info, x.Do(func(b *PackageBuilder) error {
-		// Check if we are currently building this package
-		if b.CurrentlyBuilding.MatchStageFile(pname) {
+	// Check the selected distributions before queueing anything
+	distros, err := options.BuildOptions.SelectDistributions(distributions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = x.Do(func(b *PackageBuilder) error {
+		// Check if we are currently staging or building this package
+		if b.staging[pname] {
+			return fmt.Errorf("The file `%s' is currently being staged.", pname)
+		}
+
+		if b.CurrentlyBuilding.Contains(pname) {
 			return fmt.Errorf("The file `%s' is currently building. Please wait until the built is finished to build the package again.", pname)
 		}
 
@@ -177,111 +426,139 @@ func (x *PackageBuilder) Stage(pname string,
 
 		stagefile := path.Join(stagedir, pname)
 
-		f, err := os.Create(stagefile)
+		err := b.writeStageFile(stagefile, uid, func(writer io.Writer) error {
+			return fn(b, pname, writer)
+		})
 
 		if err != nil {
 			return err
 		}
 
-		if err := fn(b, f); err != nil {
-			f.Close()
+		info = NewPackageInfo(stagefile, uid)
+
+		if info == nil {
 			os.Remove(stagefile)
+			return fmt.Errorf("The file `%s' does not appear to be a package (e.g. example_1.0.tar.gz or example_1.0-1.dsc)", pname)
+		}
+
+		if info.IsDsc() {
+			if err := b.stageDscFiles(info, files, fn); err != nil {
+				info.RemoveStageFiles()
+				return err
+			}
+		}
+
+		// Dependencies are only used to order the queue, so packages
+		// without a readable debian/control are still built
+		if err := info.ReadDependencies(); err != nil && options.Verbose {
+			fmt.Printf("Failed to read dependencies of `%s': %s\n", pname, err)
+		}
 
+		b.staging[pname] = true
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(distros) == 0 {
+		distros = options.BuildOptions.Distributions
+	}
+
+	// Looking up published versions runs reprepro, which is done without
+	// holding the builder lock
+	if !force {
+		err = x.checkPublishedVersion(info, distros)
+	}
+
+	return info, x.Do(func(b *PackageBuilder) error {
+		delete(b.staging, pname)
+
+		if err != nil {
+			info.RemoveStageFiles()
 			return err
 		}
 
-		f.Close()
+		info.Id = atomic.AddUint64(&b.PackageId, 1)
+		info.Priority = priority
+		info.Force = force
 
-		info = NewPackageInfo(stagefile, uid)
+		if len(distributions) != 0 {
+			info.Distributions = distros
+		}
 
 		b.PackageQueue = append(b.PackageQueue, info)
-		b.notifyQueue <- true
+		b.journal(&journalEntry{Op: journalQueue, Package: info})
+		b.notify()
 
 		return nil
 	})
 }
 
+func (x *PackageBuilder) notify() {
+	// A pending notification already causes a full reschedule, so there
+	// is no need to block when the queue is full
+	select {
+	case x.notifyQueue <- true:
+	default:
+	}
+}
+
 func (x *PackageBuilder) Run() {
 	for {
 		select {
 		case _ = <-x.notifyQueue:
-			if x.CurrentlyBuilding == nil {
-				x.Do(func(b *PackageBuilder) error {
-					if len(b.PackageQueue) > 0 {
-						b.CurrentlyBuilding = b.PackageQueue[0]
-						b.PackageQueue = b.PackageQueue[1:]
-					}
-
-					return nil
-				})
-			}
-
-			if x.CurrentlyBuilding != nil {
-				binfo := x.buildPackage()
-
-				if options.Verbose {
-					if binfo.Error != nil {
-						fmt.Printf("Error building `%s': %s\n", path.Base(binfo.Info.StageFile), binfo.Error)
-					} else {
-						fmt.Printf("Finished building `%s'\n", path.Base(binfo.Info.StageFile))
-					}
-				}
-
-				x.Do(func(b *PackageBuilder) error {
-					b.FinishedPackages = append(b.FinishedPackages, binfo)
-
-					for _, p := range binfo.Packages {
-						b.BuildInfoMap[p.Id] = binfo
-					}
-
-					b.CurrentlyBuilding = nil
-
-					if len(b.PackageQueue) > 0 {
-						b.notifyQueue <- true
-					}
-
-					return nil
-				})
-			}
+			x.Do(func(b *PackageBuilder) error {
+				b.schedule()
+				return nil
+			})
 		}
 	}
 }
 
-func (x *PackageBuilder) extractPackage(info *PackageInfo) (*ExtractedPackage, error) {
+func (x *PackageBuilder) extractPackage(binfo *BuildInfo) (*ExtractedPackage, error) {
+	info := binfo.Info
+
 	if options.Verbose {
 		fmt.Printf("Extracting package `%s'...\n", info.Name)
 	}
 
-	defer os.Remove(info.StageFile)
-
-	tmp := path.Join(options.Base, "tmp")
-	os.MkdirAll(tmp, 0755)
-
-	tdir, err := ioutil.TempDir(tmp, "autobuild")
+	// The package is always extracted in the same place, so that the
+	// partial results of a build interrupted by a restart are replaced
+	tdir := path.Join(options.Base, "tmp", fmt.Sprintf("autobuild-%v", info.Id))
+	os.RemoveAll(tdir)
 
-	if err != nil {
+	if err := os.MkdirAll(tdir, 0755); err != nil {
 		return nil, fmt.Errorf("Failed to create temporary directory to extract package: %s", err)
 	}
 
-	z := "gz"
+	var pack *ExtractedPackage
+	var err error
 
-	switch info.Compression {
-	case "xz":
-		z = "J"
-	case "bz2":
-		z = "j"
+	if info.IsDsc() {
+		pack, err = x.extractDscPackage(binfo, tdir)
+	} else {
+		pack, err = x.extractTarPackage(binfo, tdir)
 	}
 
-	// Extract archive
-	if err := RunCommandIn(tdir, "tar", "-x"+z+"f", info.StageFile); err != nil {
+	if err != nil {
 		os.RemoveAll(tdir)
-		return nil, fmt.Errorf("Failed to extract staged package `%s': %s", path.Base(info.StageFile), err)
+		return nil, err
 	}
 
-	// Look for options
-	bopts := options.BuildOptions
+	// Distributions selected when staging take precedence
+	if len(info.Distributions) != 0 {
+		pack.Options.Distributions = info.Distributions
+	}
 
-	f, err := os.Open(path.Join(tdir, "options"))
+	return pack, nil
+}
+
+func (x *PackageBuilder) readBuildOptions(filename string) BuildOptions {
+	bopts := options.BuildOptions.copy()
+
+	f, err := os.Open(filename)
 
 	if err == nil {
 		if options.Verbose {
@@ -293,6 +570,56 @@ func (x *PackageBuilder) extractPackage(info *PackageInfo) (*ExtractedPackage, e
 		f.Close()
 	}
 
+	return bopts
+}
+
+func (x *PackageBuilder) readPatches(patchdir string) map[string]string {
+	if options.Verbose {
+		fmt.Printf("Extracting additional patches...\n")
+	}
+
+	patches := make(map[string]string, 0)
+
+	if f, err := os.Open(patchdir); err == nil {
+		names, _ := f.Readdirnames(0)
+		f.Close()
+
+		for _, name := range names {
+			fullname := path.Join(patchdir, name)
+			ext := path.Ext(name)
+			name = name[0 : len(name)-len(ext)]
+
+			switch ext {
+			case ".xz":
+				RunCommandIn(patchdir, "unxz", fullname)
+			case ".gz":
+				RunCommandIn(patchdir, "gunzip", fullname)
+			case ".bz2":
+				RunCommandIn(patchdir, "bunzip2", fullname)
+			default:
+			}
+
+			patches[path.Base(name)] = path.Join(patchdir, name)
+		}
+	}
+
+	return patches
+}
+
+func (x *PackageBuilder) extractTarPackage(binfo *BuildInfo, tdir string) (*ExtractedPackage, error) {
+	info := binfo.Info
+
+	// Extract archive
+	cmd := MakeCommandIn(tdir, "tar", info.TarFlags()+"f", info.StageFile)
+	timeout := options.Builder.Timeouts.Duration(TimeoutExtract)
+
+	if err := x.runBuildCommand(binfo, cmd, timeout); err != nil {
+		return nil, fmt.Errorf("Failed to extract staged package `%s': %s", path.Base(info.StageFile), err)
+	}
+
+	// Look for options
+	bopts := x.readBuildOptions(path.Join(tdir, "options"))
+
 	if options.Verbose {
 		fmt.Printf("Checking for %s_%s.orig.tar.gz...\n", info.Name, info.Version)
 	}
@@ -300,8 +627,6 @@ func (x *PackageBuilder) extractPackage(info *PackageInfo) (*ExtractedPackage, e
 	origgz := path.Join(tdir, fmt.Sprintf("%s_%s.orig.tar.gz", info.Name, info.Version))
 
 	if _, err := os.Stat(origgz); err != nil {
-		os.RemoveAll(tdir)
-
 		return nil, fmt.Errorf("The stage file `%s' does not contain the original tarball `%s'",
 			path.Base(info.StageFile), path.Base(origgz))
 	}
@@ -313,51 +638,102 @@ func (x *PackageBuilder) extractPackage(info *PackageInfo) (*ExtractedPackage, e
 	diffgz := path.Join(tdir, fmt.Sprintf("%s_%s.diff.gz", info.Name, info.Version))
 
 	if _, err := os.Stat(origgz); err != nil {
-		os.RemoveAll(tdir)
-
 		return nil, fmt.Errorf("The stage file `%s' does not contain the debian diff `%s'",
 			path.Base(info.StageFile), path.Base(diffgz))
 	}
 
-	if options.Verbose {
-		fmt.Printf("Extracting additional patches...\n")
-	}
+	return &ExtractedPackage{
+		Dir:     tdir,
+		OrigGz:  origgz,
+		DiffGz:  diffgz,
+		Patches: x.readPatches(path.Join(tdir, "patches")),
+		Options: bopts,
+	}, nil
+}
 
-	// Extract patches
-	patchdir := path.Join(tdir, "patches")
-	patches := make(map[string]string, 0)
+// extractDscPackage prepares a source package (.dsc) to be built. Build
+// options and distribution specific patches are read from
+// debian/autobuild/options and debian/autobuild/patches in the source
+// package, like git-prepare-package does.
+func (x *PackageBuilder) extractDscPackage(binfo *BuildInfo, tdir string) (*ExtractedPackage, error) {
+	info := binfo.Info
 
-	if f, err := os.Open(patchdir); err == nil {
-		names, _ := f.Readdirnames(0)
+	// dpkg-source expects the referenced files next to the .dsc
+	dscdir := path.Join(tdir, "dsc")
+	os.MkdirAll(dscdir, 0755)
 
-		for _, name := range names {
-			fullname := path.Join(patchdir, name)
-			ext := path.Ext(name)
-			name = name[0 : len(name)-len(ext)]
+	dsc := path.Join(dscdir, path.Base(info.StageFile))
 
-			switch ext {
-			case ".xz":
-				RunCommandIn(tdir, "unxz", fullname)
-			case ".gz":
-				RunCommandIn(tdir, "gunzip", fullname)
-			case ".bz2":
-				RunCommandIn(tdir, "bunzip2", fullname)
-			default:
-			}
+	if err := os.Symlink(info.StageFile, dsc); err != nil {
+		return nil, err
+	}
 
-			patches[path.Base(name)] = path.Join(patchdir, name)
+	for _, name := range info.Files {
+		if err := os.Symlink(path.Join(info.StageFilesDir(), name), path.Join(dscdir, name)); err != nil {
+			return nil, err
 		}
 	}
 
+	srcdir := path.Join(tdir, "source")
+
+	cmd := MakeCommandIn(tdir, "dpkg-source", "-x", dsc, srcdir)
+	timeout := options.Builder.Timeouts.Duration(TimeoutExtract)
+
+	if err := x.runBuildCommand(binfo, cmd, timeout); err != nil {
+		return nil, fmt.Errorf("Failed to extract source package `%s': %s", path.Base(info.StageFile), err)
+	}
+
+	autobuilddir := path.Join(srcdir, "debian", "autobuild")
+	bopts := x.readBuildOptions(path.Join(autobuilddir, "options"))
+
+	patchdir := path.Join(tdir, "patches")
+	os.Rename(path.Join(autobuilddir, "patches"), patchdir)
+
+	os.RemoveAll(srcdir)
+
 	return &ExtractedPackage{
 		Dir:     tdir,
-		OrigGz:  origgz,
-		DiffGz:  diffgz,
-		Patches: patches,
+		Dsc:     dsc,
+		Patches: x.readPatches(patchdir),
 		Options: bopts,
 	}, nil
 }
 
+// unreleasedVersion returns the version of an UNRELEASED changelog entry
+// with the version suffix of the distribution. The version has to be newer
+// than the version published in the distribution. If the suffix contains a
+// build counter, the lowest counter producing a newer version is used.
+func (x *PackageBuilder) unreleasedVersion(header *ChangelogHeader, distro *Distribution) (*DebianVersion, error) {
+	published, err := publishedVersion(distro, header.Name)
+
+	if err != nil {
+		published = nil
+	}
+
+	return suffixedVersion(header.Version, published, distro)
+}
+
+// suffixedVersion returns version with the version suffix of the
+// distribution, using the lowest build counter producing a version newer
+// than published (which may be nil).
+func suffixedVersion(unsuffixed *DebianVersion, published *DebianVersion, distro *Distribution) (*DebianVersion, error) {
+	for build := 1; ; build++ {
+		version, err := ParseDebianVersion(unsuffixed.WithSuffix(distro.ExpandVersionSuffix(build)).String())
+
+		if err != nil {
+			return nil, fmt.Errorf("The version suffix of %s results in an invalid version: %s", distro.SourceName(), err)
+		}
+
+		if published == nil || version.Compare(published) > 0 {
+			return version, nil
+		}
+
+		if !distro.HasBuildCounter() || build >= 1000 {
+			return nil, fmt.Errorf("The version %s is not newer than the version %s published in %s", version, published, distro.SourceName())
+		}
+	}
+}
+
 func (x *PackageBuilder) substituteUnreleased(changelog string, distro *Distribution) error {
 	// Read complete file
 	b, err := ioutil.ReadFile(changelog)
@@ -366,10 +742,48 @@ func (x *PackageBuilder) substituteUnreleased(changelog string, distro *Distribu
 		return fmt.Errorf("Failed to open debian/changelog for substitution: %s", err)
 	}
 
-	repl := fmt.Sprintf("-${1}%s0) %s", distro.CodeName, distro.CodeName)
+	lines := strings.Split(string(b), "\n")
 
-	// Substitute
-	ret := changelogSubstituteRegex.ReplaceAllString(string(b), repl)
+	// Use the configured templates of the distribution
+	if cfg := options.BuildOptions.FindDistribution(distro); cfg != nil {
+		distro = cfg
+	}
+
+	// Substitute the top entry if it is UNRELEASED, e.g.
+	// example (1.0-1) UNRELEASED becomes example (1.0-1precise0) precise
+	for i, line := range lines {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		header := ParseChangelogHeader(line)
+
+		if header == nil {
+			return fmt.Errorf("Failed to parse debian/changelog entry `%s'", line)
+		}
+
+		if header.Distribution != "UNRELEASED" {
+			break
+		}
+
+		version, err := x.unreleasedVersion(header, distro)
+
+		if err != nil {
+			return err
+		}
+
+		header.Version = version
+		header.Distribution = distro.ExpandSuite()
+
+		if len(header.Distribution) == 0 || strings.ContainsAny(header.Distribution, " \t;") {
+			return fmt.Errorf("Invalid suite `%s' for %s", header.Distribution, distro.SourceName())
+		}
+
+		lines[i] = header.String()
+		break
+	}
+
+	ret := strings.Join(lines, "\n")
 
 	// Write changelog back
 	if err := ioutil.WriteFile(changelog, []byte(ret), 0644); err != nil {
@@ -533,18 +947,17 @@ func (x *PackageBuilder) moveResults(binfo *BuildInfo, info *DistroBuildInfo, re
 	return nil
 }
 
-func (x *PackageBuilder) extractSourcePackage(info *BuildInfo, distro *Distribution) error {
+func (x *PackageBuilder) extractTarSource(info *BuildInfo, distro *Distribution, builddir string, pkgdir string) error {
 	pack := info.Package
 
-	pkgdir := path.Join(pack.Dir, fmt.Sprintf("%s-%s", info.Info.Name, info.Info.Version))
-	os.RemoveAll(pkgdir)
-
 	if options.Verbose {
 		fmt.Printf("Extracting: %v...\n", pack.OrigGz)
 	}
 
 	// Extract original orig.tar.gz
-	if err := RunCommandIn(pack.Dir, "tar", "-xzf", pack.OrigGz); err != nil {
+	cmd := MakeCommandIn(builddir, "tar", "-xzf", pack.OrigGz)
+
+	if err := x.runBuildCommand(info, cmd, pack.Timeout(distro, TimeoutExtract)); err != nil {
 		return fmt.Errorf("Failed to extract original tarball `%s': %s",
 			path.Base(pack.OrigGz), err)
 	}
@@ -577,22 +990,70 @@ func (x *PackageBuilder) extractSourcePackage(info *BuildInfo, distro *Distribut
 			path.Base(pack.DiffGz), err)
 	}
 
-	if options.Verbose {
-		fmt.Printf("Patching...\n")
+	if options.Verbose {
+		fmt.Printf("Patching...\n")
+	}
+
+	cmd = MakeCommandIn(pkgdir, "patch", "-p1")
+	cmd.Stdin = rd
+
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to run debian debian patch: %s",
+			string(out))
+	}
+
+	return nil
+}
+
+func (x *PackageBuilder) extractDscSource(info *BuildInfo, distro *Distribution, builddir string, pkgdir string) error {
+	pack := info.Package
+
+	if options.Verbose {
+		fmt.Printf("Extracting source package: %v...\n", pack.Dsc)
+	}
+
+	cmd := MakeCommandIn(builddir, "dpkg-source", "-x", pack.Dsc, pkgdir)
+
+	if err := x.runBuildCommand(info, cmd, pack.Timeout(distro, TimeoutExtract)); err != nil {
+		return fmt.Errorf("Failed to extract source package `%s': %s",
+			path.Base(pack.Dsc), err)
+	}
+
+	// Building the source package again requires the original tarballs
+	// next to the source
+	for _, name := range info.Info.Files {
+		if isOrigTarball(name) {
+			os.Symlink(path.Join(info.Info.StageFilesDir(), name), path.Join(builddir, name))
+		}
 	}
 
-	cmd := MakeCommandIn(pkgdir, "patch", "-p1")
-	cmd.Stdin = rd
+	return nil
+}
 
-	cmd.Stdout = nil
-	cmd.Stderr = nil
+func (x *PackageBuilder) extractSourcePackage(info *BuildInfo, distro *Distribution, arch string) error {
+	return x.extractSourcePackageIn(info, distro, info.buildDir(distro, arch), info.sourceDir(distro, arch))
+}
 
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("Failed to run debian debian patch: %s",
-			string(out))
+func (x *PackageBuilder) extractSourcePackageIn(info *BuildInfo, distro *Distribution, builddir string, pkgdir string) error {
+	pack := info.Package
+
+	os.RemoveAll(builddir)
+	os.MkdirAll(builddir, 0755)
+
+	var err error
+
+	if len(pack.Dsc) != 0 {
+		err = x.extractDscSource(info, distro, builddir, pkgdir)
+	} else {
+		err = x.extractTarSource(info, distro, builddir, pkgdir)
 	}
 
-	dgz.Close()
+	if err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(path.Join(pkgdir, "debian")); err != nil {
 		return fmt.Errorf("Could not find `debian' directory after applying debian patch")
@@ -639,28 +1100,65 @@ func (x *PackageBuilder) buildSourcePackage(info *BuildInfo, distro *Distributio
 			Architectures: []string{"source"},
 		},
 
-		Id: atomic.AddUint64(&x.PackageId, 1),
+		Id:      atomic.AddUint64(&x.PackageId, 1),
+		Started: time.Now(),
 	}
 
+	src.output = NewBuildLog()
+	defer src.output.Close()
+
+	// Store the log on every exit path, before closing it
+	defer x.storeLog(info, src)
+
+	x.startStep(info, src)
+
 	if options.Verbose {
 		fmt.Printf("Building source package...\n")
 	}
 
-	src.Error = WrapError(x.extractSourcePackage(info, distro))
+	if src.Error = WrapError(x.runStepHooks(HookPreSource, info, src)); src.Error != nil {
+		return src
+	}
+
+	src.Error = WrapError(x.extractSourcePackage(info, distro, "source"))
 
 	if src.Error != nil {
-		info.Packages[src.Id] = src
 		return src
 	}
 
-	pkgdir := path.Join(info.Package.Dir, fmt.Sprintf("%s-%s", info.Info.Name, info.Info.Version))
+	localrepo, err := x.prepareLocalRepository(info, distro, "source")
+
+	if err != nil {
+		src.Error = WrapError(err)
+		return src
+	}
+
+	if src.Error = WrapError(x.prepareBuildEnvironment(info, src, distro, "source")); src.Error != nil {
+		return src
+	}
+
+	if x.checkPublishedSource(info, src, distro) {
+		return src
+	}
+
+	cachekey := x.buildCacheKey(info, src, distro, "source", localrepo)
+
+	if x.reuseCachedBuild(info, src, cachekey) {
+		x.runPostStepHooks(HookPostSource, info, src)
+		return src
+	}
+
+	pkgdir := info.sourceDir(distro, "source")
+	resultsdir := info.resultsDir(distro, "source")
+
+	os.MkdirAll(resultsdir, 0755)
 
 	// Call pdebuild
 	cmd := MakeCommandIn(pkgdir,
 		"pdebuild",
 		"--pbuilder", options.Pbuilder,
 		"--configfile", path.Join(options.Base, "etc", "pbuilderrc"),
-		"--buildresult", info.BuildResultsDir,
+		"--buildresult", resultsdir,
 		"--debbuildopts", "-us",
 		"--debbuildopts", "-uc",
 		"--debbuildopts", "-S")
@@ -669,154 +1167,181 @@ func (x *PackageBuilder) buildSourcePackage(info *BuildInfo, distro *Distributio
 	cmd.Env = append(cmd.Env, fmt.Sprintf("DIST=%s/%s", distro.Os, distro.CodeName))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("AUTOBUILD_BASE=%s", options.Base))
 
+	if len(localrepo) != 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("AUTOBUILD_LOCAL_REPO=%s", localrepo))
+	}
+
+	x.applyBuildEnvironment(cmd, src)
+
 	var wr io.Writer
-	log := &bytes.Buffer{}
 
 	if options.Verbose {
-		wr = io.MultiWriter(log, os.Stdout)
+		wr = io.MultiWriter(src.output, os.Stdout)
 	} else {
-		wr = log
+		wr = src.output
 	}
 
 	cmd.Stdout = wr
 	cmd.Stderr = wr
 
 	if options.Verbose {
-		fmt.Printf("Run pdebuild for source in `%s'...\n", info.Package.Dir)
+		fmt.Printf("Run pdebuild for source in `%s'...\n", pkgdir)
 	}
 
-	src.Error = WrapError(cmd.Run())
+	err = x.runBuildCommand(info, cmd, info.Package.Timeout(distro, TimeoutSource))
 
-	src.Log = log.String()
+	_, src.TimedOut = err.(*TimeoutError)
+	src.Error = WrapError(err)
 
 	if src.Error != nil {
-		os.RemoveAll(info.BuildResultsDir)
+		os.RemoveAll(resultsdir)
 	} else {
 		// Move build results to incoming
-		x.moveResults(info, src, info.BuildResultsDir)
+		x.moveResults(info, src, resultsdir)
+		x.storeCachedBuild(src, cachekey)
 	}
 
-	info.Packages[src.Id] = src
+	x.runPostStepHooks(HookPostSource, info, src)
+
 	return src
 }
 
-func (x *PackageBuilder) buildBinaryPackages(info *BuildInfo, src *DistroBuildInfo, distro *Distribution, arch string, buildBinaryIndep bool) error {
-	bin := &DistroBuildInfo{
-		IncomingDir: path.Join(options.Base, "incoming", distro.Os, distro.CodeName),
-
-		Distribution: Distribution{
-			Os:            distro.Os,
-			CodeName:      distro.CodeName,
-			Architectures: []string{arch},
-		},
-
-		Id: atomic.AddUint64(&x.PackageId, 1),
-	}
-
-	var debBuildOpt string
-
-	if buildBinaryIndep == true {
-		debBuildOpt = "-b"
-	} else {
-		// from 'man depkg-buildpackage' -B : build binary package, limited to binary dependent
-		debBuildOpt = "-B"
-	}
-
-	pkgdir := path.Join(info.Package.Dir, fmt.Sprintf("%s-%s", info.Info.Name, info.Info.Version))
-
+// binaryBuildCommand returns the pdebuild command building the binary
+// packages of the source in pkgdir.
+func (x *PackageBuilder) binaryBuildCommand(bin *DistroBuildInfo, distro *Distribution, arch string, debBuildOpt string, pkgdir string, resultsdir string, localrepo string) *exec.Cmd {
 	// Call pdebuild
 	cmd := MakeCommandIn(pkgdir,
 		"pdebuild",
 		"--pbuilder", options.Pbuilder,
 		"--configfile", path.Join(options.Base, "etc", "pbuilderrc"),
-		"--buildresult", info.BuildResultsDir,
+		"--buildresult", resultsdir,
 		"--debbuildopts", "-us",
 		"--debbuildopts", "-uc",
 		"--debbuildopts", debBuildOpt)
 
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, fmt.Sprintf("DIST=%s/%s", distro.Os, distro.CodeName))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("ARCH=%s", arch))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("AUTOBUILD_BASE=%s", options.Base))
 
+	if crossBuilt(distro, arch) {
+		// Cross build in the environment of the host architecture, see
+		// pbuilderrc for the cross build dependencies
+		host, _ := hostArchitecture()
+
+		cmd.Args = append(cmd.Args, "--debbuildopts", "--host-arch="+arch)
+
+		cmd.Env = append(cmd.Env, fmt.Sprintf("ARCH=%s", host))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("AUTOBUILD_HOST_ARCH=%s", arch))
+	} else {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("ARCH=%s", arch))
+	}
+
+	if len(localrepo) != 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("AUTOBUILD_LOCAL_REPO=%s", localrepo))
+	}
+
+	x.applyBuildEnvironment(cmd, bin)
+
 	var wr io.Writer
-	log := &bytes.Buffer{}
 
 	if options.Verbose {
-		wr = io.MultiWriter(log, os.Stdout)
+		wr = io.MultiWriter(bin.output, os.Stdout)
 	} else {
-		wr = log
+		wr = bin.output
 	}
 
 	cmd.Stdout = wr
 	cmd.Stderr = wr
 
-	bin.Error = WrapError(cmd.Run())
+	return cmd
+}
+
+func (x *PackageBuilder) buildBinaryPackages(info *BuildInfo, src *DistroBuildInfo, distro *Distribution, arch string, buildBinaryIndep bool) *DistroBuildInfo {
+	bin := &DistroBuildInfo{
+		IncomingDir: path.Join(options.Base, "incoming", distro.Os, distro.CodeName),
 
-	bin.Log = log.String()
+		Distribution: Distribution{
+			Os:            distro.Os,
+			CodeName:      distro.CodeName,
+			Architectures: []string{arch},
+		},
 
-	if bin.Error != nil {
-		os.RemoveAll(info.BuildResultsDir)
-	} else {
-		// Move build results to incoming (skipping source files)
-		x.moveResults(info, bin, info.BuildResultsDir, src.Files...)
+		Id:      atomic.AddUint64(&x.PackageId, 1),
+		Started: time.Now(),
 	}
 
-	info.Packages[bin.Id] = bin
-	return bin.Error
-}
+	bin.output = NewBuildLog()
+	defer bin.output.Close()
 
-func (x *PackageBuilder) buildPackage() *BuildInfo {
-	info := x.CurrentlyBuilding
+	// Store the log on every exit path, before closing it
+	defer x.storeLog(info, bin)
 
-	if options.Verbose {
-		fmt.Printf("Building package %v (%v): %v\n", info.StageFile, info.Name, info.Version)
+	x.startStep(info, bin)
+
+	var debBuildOpt string
+
+	if buildBinaryIndep == true {
+		debBuildOpt = "-b"
+	} else {
+		// from 'man depkg-buildpackage' -B : build binary package, limited to binary dependent
+		debBuildOpt = "-B"
 	}
 
-	binfo := &BuildInfo{
-		Info:     info,
-		Packages: make(map[uint64]*DistroBuildInfo),
+	if bin.Error = WrapError(x.runStepHooks(HookPreBinary, info, bin)); bin.Error != nil {
+		return bin
 	}
 
-	pack, err := x.extractPackage(info)
+	// Every architecture builds from its own copy of the source so that
+	// architectures can be built in parallel
+	bin.Error = WrapError(x.extractSourcePackage(info, distro, arch))
 
-	if err != nil {
-		binfo.Error = WrapError(err)
-		return binfo
+	if bin.Error != nil {
+		return bin
 	}
 
-	buildresult := path.Join(pack.Dir, "result")
+	localrepo, err := x.prepareLocalRepository(info, distro, arch)
+
+	if err != nil {
+		bin.Error = WrapError(err)
+		return bin
+	}
 
-	os.RemoveAll(buildresult)
-	os.MkdirAll(buildresult, 0755)
+	if bin.Error = WrapError(x.prepareBuildEnvironment(info, bin, distro, arch)); bin.Error != nil {
+		return bin
+	}
 
-	binfo.BuildResultsDir = buildresult
-	binfo.Package = pack
+	cachekey := x.buildCacheKey(info, bin, distro, arch, localrepo, debBuildOpt, strings.Join(src.Files, " "))
 
-	defer os.RemoveAll(pack.Dir)
+	if x.reuseCachedBuild(info, bin, cachekey) {
+		x.runPostStepHooks(HookPostBinary, info, bin)
+		return bin
+	}
 
-	// For each distribution
-	for _, distro := range pack.Options.Distributions {
-		src := x.buildSourcePackage(binfo, distro)
+	pkgdir := info.sourceDir(distro, arch)
+	resultsdir := info.resultsDir(distro, arch)
 
-		if src.Error != nil {
-			binfo.Error = src.Error
-			return binfo
-		}
+	os.MkdirAll(resultsdir, 0755)
 
-		for i, arch := range distro.Architectures {
-			//we build binary-indep packages only for the first architecture supported
-			buildBinaryIndep := i == 0
+	cmd := x.binaryBuildCommand(bin, distro, arch, debBuildOpt, pkgdir, resultsdir, localrepo)
+	err = x.runBuildCommand(info, cmd, info.Package.Timeout(distro, TimeoutBinary))
 
-			err := x.buildBinaryPackages(binfo, src, distro, arch, buildBinaryIndep)
+	_, bin.TimedOut = err.(*TimeoutError)
+	bin.Error = WrapError(err)
 
-			if err != nil {
-				binfo.Error = err
-			}
-		}
+	if bin.Error != nil {
+		os.RemoveAll(resultsdir)
+	} else {
+		// Move build results to incoming (skipping source files)
+		x.moveResults(info, bin, resultsdir, src.Files...)
+		x.checkReproducible(info, bin, distro, arch, debBuildOpt, localrepo)
+		x.runLintian(info, bin, distro, arch)
+		x.runTests(info, bin, distro, arch)
+		x.storeCachedBuild(bin, cachekey)
 	}
 
-	return binfo
+	x.runPostStepHooks(HookPostBinary, info, bin)
+
+	return bin
 }
 
 type Uint64Slice []uint64
@@ -886,6 +1411,10 @@ func (x *PackageBuilder) removeFinished() {
 	for _, res := range x.FinishedPackages {
 		if len(res.Packages) != 0 {
 			finishedp = append(finishedp, res)
+		} else {
+			// Stage files of failed builds are kept to be able to
+			// retry them
+			res.Info.RemoveStageFiles()
 		}
 	}
 
@@ -906,56 +1435,229 @@ func (x *PackageBuilder) filterOwned(ids []uint64, uid uint32) []uint64 {
 	return ret
 }
 
+// Discard removes finished builds. The builder lock is only taken to
+// remove the builds, the discard hooks run without holding it.
 func (x *PackageBuilder) Discard(ids []uint64, uid uint32) ([]uint64, error) {
-	retval := make([]uint64, 0, len(ids))
+	type discardStep struct {
+		binfo *BuildInfo
+		info  *DistroBuildInfo
+	}
 
-	return retval, x.Do(func(b *PackageBuilder) error {
-		ids = x.filterOwned(ids, uid)
+	steps := make([]discardStep, 0, len(ids))
+
+	x.Do(func(b *PackageBuilder) error {
+		ids = b.filterOwned(ids, uid)
+
+		for _, id := range ids {
+			if binfo := b.BuildInfoMap[id]; binfo != nil {
+				steps = append(steps, discardStep{binfo, binfo.Packages[id]})
+			}
+		}
+
+		return nil
+	})
+
+	// Builds are discarded up to the first failing pre discard hook
+	var err error
+	hooked := make([]uint64, 0, len(steps))
+
+	for _, step := range steps {
+		if err = runCapturedHooks(HookPreDiscard, step.binfo, step.info); err != nil {
+			break
+		}
+
+		hooked = append(hooked, step.info.Id)
+	}
+
+	retval := make([]uint64, 0, len(hooked))
+	discarded := make(map[*DistroBuildInfo]*BuildInfo)
 
-		err := x.foreachMatchedId(ids, func(info *BuildInfo, binfo *DistroBuildInfo) error {
-			if err := x.doDiscard(binfo); err != nil {
+	x.Do(func(b *PackageBuilder) error {
+		records := make([]*HistoryRecord, 0, len(hooked))
+
+		// Builds may have been released or discarded in the meantime, which
+		// are not matched anymore
+		e := b.foreachMatchedId(hooked, func(info *BuildInfo, binfo *DistroBuildInfo) error {
+			if err := b.doDiscard(binfo); err != nil {
 				return err
 			}
 
+			discarded[binfo] = info
+
+			records = append(records, makeHistoryRecord(info, binfo, HistoryDiscarded))
 			retval = append(retval, binfo.Id)
 			return nil
 		})
 
-		x.removeFinished()
-		return err
+		if err == nil {
+			err = e
+		}
+
+		if len(retval) != 0 {
+			b.journal(&journalEntry{Op: journalDiscard, Ids: retval})
+		}
+
+		b.recordDisposition(records)
+		b.removeFinished()
+
+		return nil
 	})
+
+	for binfo, info := range discarded {
+		if e := runCapturedHooks(HookPostDiscard, info, binfo); e != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", e)
+		}
+	}
+
+	x.notifyDisposition(NotifyDiscarded, discarded)
+
+	return retval, err
 }
 
 func (x *PackageBuilder) Release(ids []uint64, uid uint32) ([]uint64, error) {
-	retval := make([]uint64, 0, len(ids))
+	x.Do(func(b *PackageBuilder) error {
+		ids = b.filterOwned(ids, uid)
+		return nil
+	})
 
-	return retval, x.Do(func(b *PackageBuilder) error {
-		runReproMutex.Lock()
+	return x.releaseBuilds(ids, false)
+}
+
+// releaseBuilds releases finished builds. Automatic releases (by the release
+// policies) are recorded as such in the build history. The builder lock is
+// only taken to move the builds to the incoming directory of the
+// repository, the release hooks and reprepro run without holding it.
+func (x *PackageBuilder) releaseBuilds(ids []uint64, automatic bool) ([]uint64, error) {
+	var blocked []string
+
+	type releaseStep struct {
+		binfo *BuildInfo
+		info  *DistroBuildInfo
+	}
+
+	steps := make([]releaseStep, 0, len(ids))
+
+	x.Do(func(b *PackageBuilder) error {
+		ids, blocked = b.filterBlocked(ids)
+
+		for _, id := range ids {
+			binfo := b.BuildInfoMap[id]
+			steps = append(steps, releaseStep{binfo, binfo.Packages[id]})
+		}
+
+		return nil
+	})
+
+	// Builds are released up to the first failing pre release hook
+	var err error
+	hooked := make([]uint64, 0, len(steps))
+
+	for _, step := range steps {
+		if err = runCapturedHooks(HookPreRelease, step.binfo, step.info); err != nil {
+			break
+		}
 
-		distros := make(map[string]Distribution)
+		hooked = append(hooked, step.info.Id)
+	}
+
+	retval := make([]uint64, 0, len(hooked))
+	distros := make(map[string]Distribution)
+	released := make(map[*DistroBuildInfo]*BuildInfo)
+
+	x.Do(func(b *PackageBuilder) error {
+		runReproMutex.Lock()
+		defer runReproMutex.Unlock()
 
-		ids = x.filterOwned(ids, uid)
+		records := make([]*HistoryRecord, 0, len(hooked))
 
-		err := x.foreachMatchedId(ids, func(info *BuildInfo, binfo *DistroBuildInfo) error {
-			if err := x.doRelease(binfo); err != nil {
+		// Builds may have been released or discarded in the meantime, which
+		// are not matched anymore
+		e := b.foreachMatchedId(hooked, func(info *BuildInfo, binfo *DistroBuildInfo) error {
+			if err := b.doRelease(binfo); err != nil {
 				return err
 			}
 
+			released[binfo] = info
+			record := makeHistoryRecord(info, binfo, HistoryReleased)
+			record.Automatic = automatic
+
 			distros[binfo.Distribution.SourceName()] = binfo.Distribution
+			records = append(records, record)
 			retval = append(retval, binfo.Id)
 
 			return nil
 		})
 
-		x.removeFinished()
-		runReproMutex.Unlock()
+		if err == nil {
+			err = e
+		}
 
-		for _, v := range distros {
-			runRepRepro(&v)
+		if len(retval) != 0 {
+			b.journal(&journalEntry{Op: journalRelease, Ids: retval})
 		}
 
-		return err
+		b.recordDisposition(records)
+		b.removeFinished()
+
+		return nil
 	})
+
+	for _, v := range distros {
+		runRepRepro(&v)
+	}
+
+	// Post release hooks run when the builds are in the repository
+	for binfo, info := range released {
+		if e := runCapturedHooks(HookPostRelease, info, binfo); e != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", e)
+		}
+	}
+
+	x.notifyDisposition(NotifyReleased, released)
+
+	if err == nil && len(blocked) != 0 {
+		err = fmt.Errorf("The release of some builds is blocked:\n  %s", strings.Join(blocked, "\n  "))
+	}
+
+	return retval, err
+}
+
+// filterBlocked removes the builds of which the release is blocked (by
+// lintian or by tests required by the release policy), returning the
+// remaining ids and the reasons of blocked builds.
+func (x *PackageBuilder) filterBlocked(ids []uint64) ([]uint64, []string) {
+	ret := make([]uint64, 0, len(ids))
+	blocked := make([]string, 0)
+
+	for _, id := range ids {
+		binfo := x.BuildInfoMap[id]
+
+		if binfo == nil {
+			continue
+		}
+
+		info := binfo.Packages[id]
+
+		if info == nil {
+			continue
+		}
+
+		if reason := info.releaseBlocked(binfo.Info.Uid); len(reason) != 0 {
+			d := info.Distribution
+
+			blocked = append(blocked, fmt.Sprintf("%s %s (%s): %s",
+				binfo.Info.Name,
+				binfo.Info.Version,
+				d.BinaryName(d.Architectures[0]),
+				reason))
+
+			continue
+		}
+
+		ret = append(ret, id)
+	}
+
+	return ret, blocked
 }
 
 func (x *PackageBuilder) foreachMatchedId(ids []uint64, fn func(info *BuildInfo, binfo *DistroBuildInfo) error) error {
@@ -990,77 +1692,167 @@ func (x *PackageBuilder) foreachMatchedId(ids []uint64, fn func(info *BuildInfo,
 	return nil
 }
 
-type PackageBuilderState struct {
-	FinishedPackages []*BuildInfo
-	PackageQueue     []*PackageInfo
-	PackageId        uint64
+func (x *PackageBuilder) findQueued(id uint64) int {
+	for i, info := range x.PackageQueue {
+		if info.Id == id {
+			return i
+		}
+	}
+
+	return -1
 }
 
-func (x *PackageBuilder) Save() error {
-	f := path.Join(options.Base, "run", "builder.state")
+func (x *PackageBuilder) RemoveQueued(ids []uint64, uid uint32) ([]uint64, error) {
+	retval := make([]uint64, 0, len(ids))
 
-	return x.Do(func(b *PackageBuilder) error {
-		state := PackageBuilderState{
-			FinishedPackages: b.FinishedPackages,
-			PackageQueue:     b.PackageQueue,
-			PackageId:        b.PackageId,
-		}
+	return retval, x.Do(func(b *PackageBuilder) error {
+		for _, id := range ids {
+			i := b.findQueued(id)
 
-		if b.CurrentlyBuilding != nil {
-			state.PackageQueue = append([]*PackageInfo{b.CurrentlyBuilding}, state.PackageQueue...)
+			if i == -1 {
+				return fmt.Errorf("There is no queued package with id %v", id)
+			}
+
+			info := b.PackageQueue[i]
+
+			if info.Uid != uid {
+				return fmt.Errorf("The queued package `%s' is not owned by you", path.Base(info.StageFile))
+			}
+
+			info.RemoveStageFiles()
+
+			b.PackageQueue = append(b.PackageQueue[:i], b.PackageQueue[i+1:]...)
+			b.journal(&journalEntry{Op: journalRemove, Ids: []uint64{id}})
+
+			retval = append(retval, id)
 		}
 
-		fn, err := os.Create(f)
+		return nil
+	})
+}
+
+func (x *PackageBuilder) MoveQueued(id uint64, offset int, uid uint32) error {
+	return x.Do(func(b *PackageBuilder) error {
+		i := b.findQueued(id)
 
-		if err != nil {
-			return err
+		if i == -1 {
+			return fmt.Errorf("There is no queued package with id %v", id)
 		}
 
-		enc := gob.NewEncoder(fn)
+		info := b.PackageQueue[i]
 
-		if err := enc.Encode(state); err != nil {
-			return err
+		if info.Uid != uid {
+			return fmt.Errorf("The queued package `%s' is not owned by you", path.Base(info.StageFile))
+		}
+
+		// The fair policy builds packages of the same owner and priority
+		// in the order of the queue, so packages are moved among these
+		if b.Policy == SchedulePolicyFair {
+			offset = b.fairQueueOffset(i, offset)
 		}
 
-		fn.Close()
+		b.moveQueued(i, offset)
+		b.journal(&journalEntry{Op: journalMove, Ids: []uint64{id}, Offset: offset})
+
 		return nil
 	})
 }
 
-func (x *PackageBuilder) Load() error {
-	f := path.Join(options.Base, "run", "builder.state")
+// fairQueueOffset converts an offset among the queued packages with the
+// same owner and priority as the package at index i into an offset in the
+// queue.
+func (x *PackageBuilder) fairQueueOffset(i int, offset int) int {
+	info := x.PackageQueue[i]
+	peers := make([]int, 0)
+	k := 0
+
+	for j, other := range x.PackageQueue {
+		if other.Uid != info.Uid || other.Priority != info.Priority {
+			continue
+		}
 
-	return x.Do(func(b *PackageBuilder) error {
-		fn, err := os.Open(f)
+		if j == i {
+			k = len(peers)
+		}
 
-		if err == nil {
-			defer fn.Close()
+		peers = append(peers, j)
+	}
+
+	k += offset
 
-			dec := gob.NewDecoder(fn)
+	if k < 0 {
+		k = 0
+	} else if k >= len(peers) {
+		k = len(peers) - 1
+	}
+
+	return peers[k] - i
+}
 
-			state := &PackageBuilderState{}
-			err := dec.Decode(state)
+func (x *PackageBuilder) moveQueued(i int, offset int) {
+	info := x.PackageQueue[i]
+	j := i + offset
 
-			if err != nil {
-				return err
+	if j < 0 {
+		j = 0
+	} else if j >= len(x.PackageQueue) {
+		j = len(x.PackageQueue) - 1
+	}
+
+	x.PackageQueue = append(x.PackageQueue[:i], x.PackageQueue[i+1:]...)
+	x.PackageQueue = append(x.PackageQueue[:j], append([]*PackageInfo{info}, x.PackageQueue[j:]...)...)
+}
+
+func (x *PackageBuilder) Cancel(ids []uint64, uid uint32) ([]uint64, error) {
+	retval := make([]uint64, 0, len(ids))
+
+	return retval, x.Do(func(b *PackageBuilder) error {
+		for _, id := range ids {
+			binfo := b.building[id]
+
+			if binfo == nil {
+				return fmt.Errorf("There is no package with id %v currently building", id)
 			}
 
-			b.FinishedPackages = state.FinishedPackages
+			if binfo.Info.Uid != uid {
+				return fmt.Errorf("The package `%s' is not owned by you", path.Base(binfo.Info.StageFile))
+			}
+
+			if options.Verbose {
+				fmt.Printf("Cancelling build of `%s'\n", path.Base(binfo.Info.StageFile))
+			}
 
-			b.PackageQueue = state.PackageQueue
-			b.PackageId = state.PackageId
+			binfo.cancelled = true
+			binfo.Error = ErrBuildCancelled
+			binfo.pending -= b.dropJobs(binfo)
 
-			for _, info := range b.FinishedPackages {
-				for _, binfo := range info.Packages {
-					b.BuildInfoMap[binfo.Id] = info
-				}
+			for cmd, _ := range binfo.commands {
+				KillCommandGroup(cmd, syscall.SIGTERM)
+				go b.killAfterGracePeriod(binfo, cmd)
 			}
 
-			if len(b.PackageQueue) > 0 {
-				b.notifyQueue <- true
+			// Nothing is running anymore for this package
+			if binfo.pending == 0 {
+				b.finishPackage(binfo)
 			}
 
-			return nil
+			retval = append(retval, id)
+		}
+
+		return nil
+	})
+}
+
+// killAfterGracePeriod kills a command of a cancelled build which did not
+// terminate within the grace period, like a build which timed out.
+func (x *PackageBuilder) killAfterGracePeriod(binfo *BuildInfo, cmd *exec.Cmd) {
+	// Give pbuilder the chance to clean up after itself
+	time.Sleep(killGracePeriod)
+
+	x.Do(func(b *PackageBuilder) error {
+		// Finished commands are removed from the build
+		if binfo.commands[cmd] {
+			KillCommandGroup(cmd, syscall.SIGKILL)
 		}
 
 		return nil
@@ -1084,8 +1876,7 @@ func (x *PackageBuilder) FindPackage(id uint64) (*BuildInfo, *DistroBuildInfo) {
 }
 
 func init() {
-	packageInfoRegex, _ = regexp.Compile(`(.*)[_-]([0-9]+(\.[0-9]+)+).tar.(gz|xz|bz2)`)
-	changelogSubstituteRegex, _ = regexp.Compile(`-([0-9]+)\) UNRELEASED`)
+	packageInfoRegex, _ = regexp.Compile(`^(.+)[_-]([0-9][A-Za-z0-9.+~:]*)\.tar\.(gz|xz|bz2)$`)
 
 	gob.Register(Error(""))
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BuildLog collects the output of a build step while it is running, so
+// that clients can follow it.
+type BuildLog struct {
+	mutex    sync.Mutex
+	data     []byte
+	finished bool
+	changed  chan bool
+}
+
+func NewBuildLog() *BuildLog {
+	return &BuildLog{
+		changed: make(chan bool),
+	}
+}
+
+func (x *BuildLog) Write(p []byte) (int, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.data = append(x.data, p...)
+
+	close(x.changed)
+	x.changed = make(chan bool)
+
+	return len(p), nil
+}
+
+func (x *BuildLog) Close() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if !x.finished {
+		x.finished = true
+		close(x.changed)
+	}
+
+	return nil
+}
+
+func (x *BuildLog) String() string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	return string(x.data)
+}
+
+func (x *BuildLog) read(offset int) ([]byte, bool, chan bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if offset < 0 || offset > len(x.data) {
+		offset = len(x.data)
+	}
+
+	ret := make([]byte, len(x.data)-offset)
+	copy(ret, x.data[offset:])
+
+	return ret, x.finished, x.changed
+}
+
+// Wait returns the log data from offset. If there is no new data yet, it
+// waits at most timeout for new data to arrive.
+func (x *BuildLog) Wait(offset int, timeout time.Duration) ([]byte, bool) {
+	data, finished, changed := x.read(offset)
+
+	if len(data) != 0 || finished || timeout <= 0 {
+		return data, finished
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(timeout):
+	}
+
+	data, finished, _ = x.read(offset)
+	return data, finished
+}
+
+func (x *PackageBuilder) startStep(binfo *BuildInfo, info *DistroBuildInfo) {
+	x.Do(func(b *PackageBuilder) error {
+		if binfo.steps == nil {
+			binfo.steps = make(map[uint64]*DistroBuildInfo)
+		}
+
+		binfo.steps[info.Id] = info
+		return nil
+	})
+}
+
+func (x *PackageBuilder) findStep(id uint64) *DistroBuildInfo {
+	for _, binfo := range x.building {
+		if info := binfo.steps[id]; info != nil {
+			return info
+		}
+	}
+
+	return nil
+}
+
+// ReadLog returns the log of the build step with the given id, starting at
+// offset. For running builds, it waits at most timeout for new output.
+func (x *PackageBuilder) ReadLog(id uint64, offset int, timeout time.Duration) ([]byte, bool, error) {
+	var output *BuildLog
+	var info *DistroBuildInfo
+
+	x.Do(func(b *PackageBuilder) error {
+		if step := b.findStep(id); step != nil {
+			output = step.output
+		} else {
+			_, info = b.FindPackage(id)
+		}
+
+		return nil
+	})
+
+	if output != nil {
+		data, finished := output.Wait(offset, timeout)
+		return data, finished, nil
+	}
+
+	var log []byte
+	var err error
+
+	if info != nil {
+		log, err = info.readStoredLog()
+	} else if filename := findLogFile(id); len(filename) != 0 {
+		// Logs of released or discarded packages are still stored
+		log, err = readLogFile(filename)
+	} else {
+		err = fmt.Errorf("There is no build with id %v", id)
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if offset < 0 || offset > len(log) {
+		offset = len(log)
+	}
+
+	return log[offset:], true, nil
+}
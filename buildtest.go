@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+type TestOptions struct {
+	// Test binary builds by installing them in a clean build environment,
+	// and by running autopkgtest when the package has debian/tests
+	Enabled bool `json:"enabled"`
+}
+
+type TestResult struct {
+	Passed bool
+
+	// Whether autopkgtest was run
+	Autopkgtest bool `json:",omitempty"`
+
+	// Set when the test did not pass
+	Error string `json:",omitempty"`
+}
+
+const testScript = `#!/bin/bash
+
+# Test binary packages in the build environment: $1 is the source tree of
+# the package, followed by the packages to install
+srcdir="$1"
+shift
+
+apt-get update || exit 1
+
+if ! dpkg -i "$@"; then
+	apt-get install -y -f || exit 1
+fi
+
+status=0
+
+for deb in "$@"; do
+	pkg=$(dpkg-deb -f "$deb" Package)
+
+	if ! dpkg-query -W -f='${Status}\n' "$pkg" | grep -q "install ok installed"; then
+		echo "E: $pkg could not be installed"
+		status=1
+	fi
+done
+
+[ $status -eq 0 ] || exit 1
+
+if [ -f "$srcdir/debian/tests/control" ]; then
+	echo "AUTOPKGTEST"
+
+	apt-get install -y autopkgtest || exit 1
+	autopkgtest "$srcdir" "$@" -- null
+
+	# 2 means some tests were skipped, 8 that there were no tests to run
+	status=$?
+
+	if [ $status -ne 0 ] && [ $status -ne 2 ] && [ $status -ne 8 ]; then
+		echo "E: autopkgtest failed with exit status $status"
+		exit 1
+	fi
+fi
+`
+
+func (x *TestResult) String() string {
+	if x.Passed {
+		if x.Autopkgtest {
+			return "passed (including autopkgtest)"
+		}
+
+		return "passed"
+	}
+
+	return "failed: " + x.Error
+}
+
+// testDebs returns the binary packages to test for a binary build, which
+// are the packages of the build itself. The architecture independent
+// packages are only built for the first architecture of the distribution,
+// so these are added from that step for the other architectures. The
+// other architectures are not built before that step finished when tests
+// are enabled (see waitingForIndep).
+func (x *PackageBuilder) testDebs(binfo *BuildInfo, info *DistroBuildInfo, distro *Distribution, arch string) []string {
+	debs := make([]string, 0)
+
+	for _, f := range info.ChangesFiles {
+		if strings.HasSuffix(f, ".deb") {
+			debs = append(debs, f)
+		}
+	}
+
+	if arch == distro.Architectures[0] {
+		return debs
+	}
+
+	x.Do(func(b *PackageBuilder) error {
+		indep := binfo.finishedStep(distro, distro.Architectures[0])
+
+		if indep == nil || indep.Error != nil {
+			return nil
+		}
+
+		for _, f := range indep.ChangesFiles {
+			if strings.HasSuffix(f, "_all.deb") {
+				debs = append(debs, f)
+			}
+		}
+
+		return nil
+	})
+
+	return debs
+}
+
+// waitingForIndep returns whether a binary build job has to wait for the
+// build of the architecture independent packages of its distribution,
+// which are needed to test the packages built by the job.
+func (x *PackageBuilder) waitingForIndep(job *buildJob) bool {
+	if job.IsSource() || job.BuildIndep || !job.Build.Package.Options.Tests.Enabled {
+		return false
+	}
+
+	// The first architecture is always queued along with the others
+	// unless it already finished, so this does not wait forever
+	return job.Build.finishedStep(job.Distribution, job.Distribution.Architectures[0]) == nil
+}
+
+// runTests installs the packages of a successful binary build in a clean
+// copy of the build environment of the distribution, and runs autopkgtest
+// if the package has debian/tests. The output is appended to the build log.
+func (x *PackageBuilder) runTests(binfo *BuildInfo, info *DistroBuildInfo, distro *Distribution, arch string) {
+	if !binfo.Package.Options.Tests.Enabled {
+		return
+	}
+
+	// Packages of a foreign architecture cannot be installed in the build
+	// environment of the host
+	if crossBuilt(distro, arch) {
+		fmt.Fprintf(info.output, "\nSkipping tests of packages cross-built for %s\n", arch)
+		return
+	}
+
+	info.Test = &TestResult{}
+
+	debs := x.testDebs(binfo, info, distro, arch)
+
+	if len(debs) == 0 {
+		info.Test.Passed = true
+		return
+	}
+
+	srcdir := binfo.sourceDir(distro, arch)
+	script := path.Join(binfo.buildDir(distro, arch), "test.sh")
+
+	if err := ioutil.WriteFile(script, []byte(testScript), 0755); err != nil {
+		info.Test.Error = err.Error()
+		return
+	}
+
+	fmt.Fprintf(info.output, "\nTesting %v packages...\n", len(debs))
+
+	cmd := MakeCommandIn(srcdir,
+		options.Pbuilder,
+		"--execute",
+		"--configfile", path.Join(options.Base, "etc", "pbuilderrc"),
+		"--bindmounts", srcdir+" "+info.IncomingDir,
+		"--",
+		script,
+		srcdir)
+
+	cmd.Args = append(cmd.Args, debs...)
+
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("DIST=%s/%s", distro.Os, distro.CodeName))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("ARCH=%s", arch))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("AUTOBUILD_BASE=%s", options.Base))
+
+	var output bytes.Buffer
+	wr := io.MultiWriter(info.output, &output)
+
+	cmd.Stdout = wr
+	cmd.Stderr = wr
+
+	err := x.runBuildCommand(binfo, cmd, binfo.Package.Timeout(distro, TimeoutBinary))
+
+	info.Test.Autopkgtest = strings.Contains(output.String(), "AUTOPKGTEST\n")
+
+	if err != nil {
+		info.Test.Error = err.Error()
+	} else {
+		info.Test.Passed = true
+	}
+
+	fmt.Fprintf(info.output, "Tests %s\n", info.Test)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+func mountsBelow(dir string) []string {
+	f, err := os.Open("/proc/mounts")
+
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	ret := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) > 1 && strings.HasPrefix(fields[1], dir+"/") {
+			ret = append(ret, fields[1])
+		}
+	}
+
+	return ret
+}
+
+// cleanupBuildPlaces removes the build chroots left behind by pbuilder
+// processes which were killed before they could clean up themselves.
+func cleanupBuildPlaces() {
+	builddir := path.Join(options.Base, "pbuilder", "build")
+
+	f, err := os.Open(builddir)
+
+	if err != nil {
+		return
+	}
+
+	names, _ := f.Readdirnames(0)
+	f.Close()
+
+	for _, name := range names {
+		// Build places are named after the pid of the builder
+		pid, err := strconv.Atoi(strings.TrimPrefix(name, "cow."))
+
+		if err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+			continue
+		}
+
+		dir := path.Join(builddir, name)
+		mounts := mountsBelow(dir)
+
+		// Unmount in reverse order to handle nested mounts
+		for i := len(mounts) - 1; i >= 0; i-- {
+			RunCommand("umount", "-l", mounts[i])
+		}
+
+		// Never remove a chroot which still has something mounted (such
+		// as the repository)
+		if len(mountsBelow(dir)) != 0 {
+			fmt.Fprintf(os.Stderr, "Failed to unmount everything in `%s', not removing build place\n", dir)
+			continue
+		}
+
+		if options.Verbose {
+			fmt.Printf("Removing stale build place `%s'\n", dir)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path"
+	"time"
 )
 
 type DaemonCommands struct {
 }
 
 type Stage struct {
-	Filename string
-	Data     []byte
+	Filename      string
+	Data          []byte
+	Priority      int
+	Distributions []string
+	Force         bool
+
+	// Files referenced by a source package (.dsc)
+	Files map[string][]byte
 
 	Uid uint32
 }
@@ -36,18 +45,103 @@ type PackageIdsReply struct {
 
 type Release PackageIds
 type Discard PackageIds
+type Retry PackageIds
 
 type ReleaseReply PackageIdsReply
 type DiscardReply PackageIdsReply
+type RetryReply PackageIdsReply
 
 type GeneralReply struct {
 }
 
+type Queue struct {
+	Uid uint32
+}
+
+type QueuedStep struct {
+	Id           uint64
+	Distribution Distribution
+}
+
+type QueuedPackage struct {
+	Id        uint64
+	Name      string
+	Version   string
+	StageFile string
+	Uid       uint32
+	Owner     string
+	Priority  int
+	Steps     []QueuedStep
+}
+
+type QueueReply struct {
+	Building []QueuedPackage
+	Queue    []QueuedPackage
+	Policy   SchedulePolicy
+}
+
+type QueueRemove PackageIds
+type QueueCancel PackageIds
+
+type QueueRemoveReply PackageIdsReply
+type QueueCancelReply PackageIdsReply
+
+type QueueMove struct {
+	Id     uint64
+	Offset int
+	Uid    uint32
+}
+
+type QueuePolicy struct {
+	Policy SchedulePolicy
+	Uid    uint32
+}
+
+type Log struct {
+	Id     uint64
+	Offset int
+
+	// Wait at most this many seconds for new output
+	Wait int
+}
+
+type History struct {
+	Filter HistoryFilter
+	Uid    uint32
+}
+
+type HistoryReply struct {
+	Records []*HistoryRecord
+}
+
+type Notifications struct {
+	Package string
+	Uid     uint32
+}
+
+type NotificationsReply struct {
+	Records []*NotificationRecord
+}
+
+type LogReply struct {
+	Data     []byte
+	Offset   int
+	Finished bool
+}
+
 type IncomingPackage struct {
 	Name         string
 	Id           uint64
 	Distribution Distribution
 	Files        []string
+	Error        string
+	TimedOut     bool
+	Lintian      *LintianResult
+	Test         *TestResult
+	Reproducible *ReproducibleResult
+	Environment  *BuildEnvironment
+	Cached       string
+	Published    string
 }
 
 type IncomingReply struct {
@@ -117,10 +211,26 @@ func (x *IncomingPackage) Matches(info *DistroBuildInfo) bool {
 }
 
 func (x *DaemonCommands) Stage(stage *Stage, reply *StageReply) error {
+	files := make([]string, 0, len(stage.Files))
+
+	for name, _ := range stage.Files {
+		files = append(files, name)
+	}
+
 	info, err := builder.Stage(path.Base(stage.Filename),
+		files,
 		stage.Uid,
-		func(b *PackageBuilder, writer io.Writer) error {
-			_, err := writer.Write(stage.Data)
+		stage.Priority,
+		stage.Distributions,
+		stage.Force,
+		func(b *PackageBuilder, name string, writer io.Writer) error {
+			data := stage.Data
+
+			if name != path.Base(stage.Filename) {
+				data = stage.Files[name]
+			}
+
+			_, err := writer.Write(data)
 			return err
 		})
 
@@ -139,11 +249,25 @@ func (x *DaemonCommands) makeIncomingPackage(d *DistroBuildInfo) IncomingPackage
 		ret[i] = f[len(options.Base)+1:]
 	}
 
+	var errs string
+
+	if d.Error != nil {
+		errs = d.Error.Error()
+	}
+
 	return IncomingPackage{
 		Name:         path.Base(d.Changes),
 		Files:        ret,
 		Distribution: d.Distribution,
 		Id:           d.Id,
+		Error:        errs,
+		TimedOut:     d.TimedOut,
+		Lintian:      d.Lintian,
+		Test:         d.Test,
+		Reproducible: d.Reproducible,
+		Environment:  d.Environment,
+		Cached:       d.Cached,
+		Published:    d.Published,
 	}
 }
 
@@ -185,3 +309,146 @@ func (x *DaemonCommands) Discard(discard *Discard, reply *DiscardReply) error {
 	reply.Packages = pkgs
 	return nil
 }
+
+func (x *DaemonCommands) Retry(retry *Retry, reply *RetryReply) error {
+	pkgs, err := builder.Retry(retry.Packages, retry.Uid)
+
+	if err != nil {
+		return err
+	}
+
+	reply.Packages = pkgs
+	return nil
+}
+
+func (x *DaemonCommands) makeQueuedPackage(info *PackageInfo) QueuedPackage {
+	owner := fmt.Sprintf("%v", info.Uid)
+
+	if us, err := user.LookupId(owner); err == nil {
+		owner = us.Username
+	}
+
+	return QueuedPackage{
+		Id:        info.Id,
+		Name:      info.Name,
+		Version:   info.Version,
+		StageFile: path.Base(info.StageFile),
+		Uid:       info.Uid,
+		Owner:     owner,
+		Priority:  info.Priority,
+	}
+}
+
+// queuedSteps returns the running build steps of a package, sorted by id.
+// Must be called with the builder lock held.
+func (x *BuildInfo) queuedSteps() []QueuedStep {
+	ids := make(Uint64Slice, 0, len(x.steps))
+
+	for id, _ := range x.steps {
+		ids = append(ids, id)
+	}
+
+	ids.Sort()
+
+	ret := make([]QueuedStep, 0, len(ids))
+
+	for _, id := range ids {
+		ret = append(ret, QueuedStep{
+			Id:           id,
+			Distribution: x.steps[id].Distribution,
+		})
+	}
+
+	return ret
+}
+
+func (x *DaemonCommands) Queue(queue *Queue, reply *QueueReply) error {
+	return builder.Do(func(b *PackageBuilder) error {
+		for _, info := range b.CurrentlyBuilding.Sorted() {
+			p := x.makeQueuedPackage(info)
+
+			if binfo := b.building[info.Id]; binfo != nil {
+				p.Steps = binfo.queuedSteps()
+			}
+
+			reply.Building = append(reply.Building, p)
+		}
+
+		for _, info := range b.scheduledQueue() {
+			reply.Queue = append(reply.Queue, x.makeQueuedPackage(info))
+		}
+
+		reply.Policy = b.Policy
+		return nil
+	})
+}
+
+func (x *DaemonCommands) QueueRemove(remove *QueueRemove, reply *QueueRemoveReply) error {
+	pkgs, err := builder.RemoveQueued(remove.Packages, remove.Uid)
+
+	if err != nil {
+		return err
+	}
+
+	reply.Packages = pkgs
+	return nil
+}
+
+func (x *DaemonCommands) QueueMove(move *QueueMove, reply *GeneralReply) error {
+	return builder.MoveQueued(move.Id, move.Offset, move.Uid)
+}
+
+func (x *DaemonCommands) QueueCancel(cancel *QueueCancel, reply *QueueCancelReply) error {
+	pkgs, err := builder.Cancel(cancel.Packages, cancel.Uid)
+
+	if err != nil {
+		return err
+	}
+
+	reply.Packages = pkgs
+	return nil
+}
+
+func (x *DaemonCommands) QueuePolicy(policy *QueuePolicy, reply *GeneralReply) error {
+	if policy.Uid != 0 && policy.Uid != uint32(os.Getuid()) {
+		return fmt.Errorf("Only root or the user running the daemon can change the scheduling policy")
+	}
+
+	return builder.SetPolicy(policy.Policy)
+}
+
+func (x *DaemonCommands) Log(log *Log, reply *LogReply) error {
+	data, finished, err := builder.ReadLog(log.Id, log.Offset, time.Duration(log.Wait)*time.Second)
+
+	if err != nil {
+		return err
+	}
+
+	reply.Data = data
+	reply.Offset = log.Offset + len(data)
+	reply.Finished = finished
+
+	return nil
+}
+
+func (x *DaemonCommands) Notifications(n *Notifications, reply *NotificationsReply) error {
+	records, err := notifications.Query(n.Package, n.Uid)
+
+	if err != nil {
+		return err
+	}
+
+	reply.Records = records
+	return nil
+}
+
+func (x *DaemonCommands) History(h *History, reply *HistoryReply) error {
+	records, err := history.Query(&h.Filter)
+
+	if err != nil {
+		return err
+	}
+
+	reply.Records = records
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseControl parses a debian control file into its paragraphs. The values
+// of fields spanning multiple lines are joined by newlines.
+func ParseControl(rd io.Reader) ([]map[string]string, error) {
+	ret := make([]map[string]string, 0)
+	scanner := bufio.NewScanner(rd)
+
+	var paragraph map[string]string
+	var field string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(strings.TrimSpace(line)) == 0 {
+			paragraph = nil
+			continue
+		}
+
+		// Comments
+		if line[0] == '#' {
+			continue
+		}
+
+		// Continuation lines
+		if line[0] == ' ' || line[0] == '\t' {
+			if paragraph == nil || len(field) == 0 {
+				return nil, fmt.Errorf("Unexpected continuation line `%s'", strings.TrimSpace(line))
+			}
+
+			paragraph[field] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid line `%s'", line)
+		}
+
+		if paragraph == nil {
+			paragraph = make(map[string]string)
+			ret = append(ret, paragraph)
+		}
+
+		field = kv[0]
+		paragraph[field] = strings.TrimSpace(kv[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// ParseDependencyNames returns the names of the packages in a relationship
+// field (e.g. Build-Depends), including all alternatives, without version
+// constraints, architecture restrictions or build profiles.
+func ParseDependencyNames(value string) []string {
+	ret := make([]string, 0)
+
+	for _, dep := range strings.Split(value, ",") {
+		for _, alt := range strings.Split(dep, "|") {
+			fields := strings.Fields(alt)
+
+			if len(fields) == 0 {
+				continue
+			}
+
+			name := fields[0]
+
+			if i := strings.IndexAny(name, "([<:"); i != -1 {
+				name = name[:i]
+			}
+
+			if len(name) != 0 {
+				ret = append(ret, name)
+			}
+		}
+	}
+
+	return ret
+}
+
+// fileFromDiff extracts a file of the debian directory (e.g.
+// debian/control) from a gzipped debian diff. Only lines added or kept by
+// the diff are used, which gives the complete file when the diff creates
+// it.
+func fileFromDiff(diffgz []byte, name string) ([]byte, error) {
+	rd, err := gzip.NewReader(bytes.NewReader(diffgz))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rd.Close()
+
+	scanner := bufio.NewScanner(rd)
+
+	var ret bytes.Buffer
+	infile := false
+	found := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "+++ ") {
+			fields := strings.Fields(line[4:])
+			infile = len(fields) != 0 && strings.HasSuffix(fields[0], "/"+name)
+
+			if infile {
+				found = true
+			}
+
+			continue
+		}
+
+		if !infile {
+			continue
+		}
+
+		if strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "diff ") {
+			infile = false
+			continue
+		}
+
+		if len(line) != 0 && (line[0] == '+' || line[0] == ' ') {
+			ret.WriteString(line[1:])
+			ret.WriteByte('\n')
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("The debian diff does not contain %s", name)
+	}
+
+	return ret.Bytes(), nil
+}
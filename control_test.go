@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseControl(t *testing.T) {
+	control := `# Comment
+Source: example
+Build-Depends: debhelper (>= 9),
+ libfoo-dev
+
+Package: example
+Architecture: any
+Description: An example
+ with a long description
+`
+
+	paragraphs, err := ParseControl(strings.NewReader(control))
+
+	if err != nil {
+		t.Fatalf("Failed to parse control: %s", err)
+	}
+
+	if len(paragraphs) != 2 {
+		t.Fatalf("Expected 2 paragraphs, got %v", len(paragraphs))
+	}
+
+	expected := []map[string]string{
+		{
+			"Source":        "example",
+			"Build-Depends": "debhelper (>= 9),\nlibfoo-dev",
+		},
+		{
+			"Package":      "example",
+			"Architecture": "any",
+			"Description":  "An example\nwith a long description",
+		},
+	}
+
+	for i, p := range expected {
+		if len(paragraphs[i]) != len(p) {
+			t.Errorf("Paragraph %v: expected %v fields, got %v", i, len(p), len(paragraphs[i]))
+		}
+
+		for k, v := range p {
+			if paragraphs[i][k] != v {
+				t.Errorf("Paragraph %v: expected %s `%s', got `%s'", i, k, v, paragraphs[i][k])
+			}
+		}
+	}
+}
+
+func TestParseControlInvalid(t *testing.T) {
+	tests := []string{
+		" continuation without field\n",
+		"Source: example\ninvalid line\n",
+	}
+
+	for _, test := range tests {
+		if _, err := ParseControl(strings.NewReader(test)); err == nil {
+			t.Errorf("Expected an error parsing `%s'", test)
+		}
+	}
+}
+
+func TestParseDependencyNames(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"debhelper", "debhelper"},
+		{"debhelper (>= 9), dh-python", "debhelper dh-python"},
+		{"libfoo-dev | libbar-dev (<< 2)", "libfoo-dev libbar-dev"},
+		{"libfoo-dev [amd64 arm64], python3:any", "libfoo-dev python3"},
+		{"debhelper(>=9),libfoo-dev[amd64]", "debhelper libfoo-dev"},
+		{"check <!nocheck>,\nlibfoo-dev", "check libfoo-dev"},
+		{" , ,libfoo-dev,", "libfoo-dev"},
+	}
+
+	for _, test := range tests {
+		names := strings.Join(ParseDependencyNames(test.value), " ")
+
+		if names != test.expected {
+			t.Errorf("ParseDependencyNames(%q): expected `%s', got `%s'", test.value, test.expected, names)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// The Debian architectures of Go architectures, used when dpkg is not
+// available to determine the host architecture
+var debianArchitectures = map[string]string{
+	"386":      "i386",
+	"amd64":    "amd64",
+	"arm":      "armhf",
+	"arm64":    "arm64",
+	"mips64le": "mips64el",
+	"ppc64le":  "ppc64el",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// hostArchitecture returns the Debian architecture of the host.
+func hostArchitecture() (string, error) {
+	out, err := RunOutputCommand("dpkg", "--print-architecture")
+
+	if err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if arch, ok := debianArchitectures[runtime.GOARCH]; ok {
+		return arch, nil
+	}
+
+	return "", fmt.Errorf("Could not determine the host architecture: %s", err)
+}
+
+// IsCross returns whether packages for arch are cross-built in the build
+// environment of the host architecture.
+func (x *Distribution) IsCross(arch string) bool {
+	for _, a := range x.CrossArchitectures {
+		if a == arch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// crossBuilt returns whether packages for arch are cross-built for the
+// configured distribution.
+func crossBuilt(distro *Distribution, arch string) bool {
+	if cfg := options.BuildOptions.FindDistribution(distro); cfg != nil {
+		distro = cfg
+	}
+
+	return distro.IsCross(arch)
+}
+
+// chrootArchitecture returns the architecture of the build environment in
+// which packages for arch are built. Source packages and cross-built
+// architectures are built in the environment of the host architecture.
+func chrootArchitecture(distro *Distribution, arch string) (string, error) {
+	if arch == "source" || crossBuilt(distro, arch) {
+		return hostArchitecture()
+	}
+
+	return arch, nil
+}
+
+// initCross adds a cross-built architecture to a distribution. Instead of
+// creating a build environment for arch, packages are built in the existing
+// environment of the host architecture.
+func (x *CommandInit) initCross(distro *Distribution, arch string) error {
+	host, err := hostArchitecture()
+
+	if err != nil {
+		return err
+	}
+
+	if arch == host {
+		return fmt.Errorf("Cannot cross-build for the host architecture `%s'", arch)
+	}
+
+	basepath := path.Join(options.Base, "pbuilder", distro.Os, distro.CodeName+"-"+host, "base.cow")
+
+	if _, err := os.Stat(basepath); err != nil {
+		return fmt.Errorf("Cross-building for %s requires the build environment of the host architecture, please run `autobuild init %s/%s' first",
+			distro.BinaryName(arch),
+			distro.SourceName(),
+			host)
+	}
+
+	if err := checkPbuilderSupport("cross-building", "AUTOBUILD_HOST_ARCH", "D04autobuild-cross"); err != nil {
+		return err
+	}
+
+	if err := x.AddDistribution(distro, arch); err != nil {
+		return err
+	}
+
+	err = options.UpdateConfig(func(opts *Options) error {
+		distcfg := opts.BuildOptions.FindDistribution(distro)
+
+		if distcfg != nil && !distcfg.IsCross(arch) {
+			distcfg.CrossArchitectures = append(distcfg.CrossArchitectures, arch)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Packages for %s will be cross-built in the build environment of %s\n",
+		distro.BinaryName(arch),
+		distro.BinaryName(host))
+
+	return nil
+}
@@ -32,6 +32,11 @@ func (x *CommandDaemon) Execute(args []string) error {
 		fmt.Fprintf(os.Stderr, "Failed to load builder state: %s\n", err)
 	}
 
+	// Interrupted builds are resumed by building their unfinished steps
+	// from scratch, so anything they left behind can be removed
+	cleanupBuildPlaces()
+	os.RemoveAll(path.Join(options.Base, "tmp"))
+
 	defer func() {
 		if err := builder.Save(); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to save builder state: %s\n", err)
@@ -66,6 +71,8 @@ func (x *CommandDaemon) Execute(args []string) error {
 
 	defer os.Remove(path.Join(options.Base, "run", "autobuild.sock"))
 	go builder.Run()
+	go builder.RunLogRetention()
+	go builder.RunCheckpoints()
 
 	for {
 		select {
@@ -84,6 +91,6 @@ func (x *CommandDaemon) Execute(args []string) error {
 func init() {
 	parser.AddCommand("daemon",
 		"Run the autobuild build daemon",
-		"The daemon command runs the autobuild build daemon. The build daemon performs several tasks. First, it manages the package queue and listens for client commands to stage or release packages. It also runs a webserver serving the repository contents over http.",
+		"The daemon command runs the autobuild build daemon. The build daemon performs several tasks. First, it manages the package queue and listens for client commands to stage or release packages. It also runs a webserver serving the repository contents over http. Hooks can be run at the phases of a build (pre-extract, pre-source, post-source, pre-binary, post-binary, pre-release, post-release, pre-discard and post-discard). The executable files in etc/hooks/<phase>.d/ under the base directory are run in order of their names, followed by the commands configured for the phase in \"hooks\" in autobuild.json. A failing pre hook fails the build step, or refuses to release or discard the build, and its output is captured in the build log. Hooks are run with the environment variables "+hookEnvironment+". When \"notifications\" are configured, the daemon posts a JSON notification to the configured webhooks and emails the owner of a package when its build finishes, or when builds are released or discarded. Failed deliveries are retried, and all deliveries are recorded (see `autobuild history --notifications').",
 		&CommandDaemon{})
 }
@@ -2,14 +2,40 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 )
 
 type Distribution struct {
 	Os            string   `json:"os"`
 	CodeName      string   `json:"codename"`
 	Architectures []string `json:"architectures"`
+
+	// The release version of the distribution (e.g. 22.04 or 12)
+	Version string `json:"version,omitempty"`
+
+	// Templates for the version suffix (e.g. ~ubuntu${version}.${build})
+	// and the suite (e.g. ${codename}) substituted in UNRELEASED changelog
+	// entries. Available variables are os, codename, version and build,
+	// the lowest build counter (starting at 1) which makes the version
+	// newer than the published version. Suites other than the codename
+	// need to be allowed in the reprepro incoming configuration.
+	VersionSuffix string `json:"version-suffix,omitempty"`
+	Suite         string `json:"suite,omitempty"`
+
+	Timeouts *BuildTimeouts `json:"timeouts,omitempty"`
+
+	// Architectures (e.g. arm64) which are cross-built in the build
+	// environment of the host architecture, see autobuild init --cross
+	CrossArchitectures []string `json:"cross-architectures,omitempty"`
 }
 
+const (
+	DefaultVersionSuffix = "${codename}0"
+	DefaultSuite         = "${codename}"
+)
+
 func (x *Distribution) SourceName() string {
 	return fmt.Sprintf("%s/%s", x.Os, x.CodeName)
 }
@@ -21,3 +47,44 @@ func (x *Distribution) BinaryName(arch string) string {
 func (x *Distribution) IsSource() bool {
 	return len(x.Architectures) == 1 && x.Architectures[0] == "source"
 }
+
+func (x *Distribution) expand(template string, build int) string {
+	return os.Expand(template, func(name string) string {
+		switch name {
+		case "os":
+			return x.Os
+		case "codename":
+			return x.CodeName
+		case "version":
+			return x.Version
+		case "build":
+			return strconv.Itoa(build)
+		}
+
+		return ""
+	})
+}
+
+// ExpandVersionSuffix returns the version suffix for the given build counter.
+func (x *Distribution) ExpandVersionSuffix(build int) string {
+	if len(x.VersionSuffix) == 0 {
+		return x.expand(DefaultVersionSuffix, build)
+	}
+
+	return x.expand(x.VersionSuffix, build)
+}
+
+// ExpandSuite returns the suite of UNRELEASED packages.
+func (x *Distribution) ExpandSuite() string {
+	if len(x.Suite) == 0 {
+		return x.expand(DefaultSuite, 0)
+	}
+
+	return x.expand(x.Suite, 0)
+}
+
+// HasBuildCounter returns whether the version suffix depends on the build
+// counter.
+func (x *Distribution) HasBuildCounter() bool {
+	return strings.Contains(x.VersionSuffix, "$build") || strings.Contains(x.VersionSuffix, "${build}")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type DscFile struct {
+	Name     string
+	Size     int64
+	Checksum string
+}
+
+// Dsc is a parsed Debian source control (.dsc) file.
+type Dsc struct {
+	Source  string
+	Version string
+	Format  string
+
+	// The files listed per checksum field (Files, Checksums-Sha1,
+	// Checksums-Sha256)
+	Checksums map[string][]DscFile
+
+	// The values of all other fields
+	Fields map[string]string
+}
+
+var dscChecksumFields = map[string]func() hash.Hash{
+	"Files":            md5.New,
+	"Checksums-Sha1":   sha1.New,
+	"Checksums-Sha256": sha256.New,
+}
+
+func ParseDsc(rd io.Reader) (*Dsc, error) {
+	ret := &Dsc{
+		Checksums: make(map[string][]DscFile),
+		Fields:    make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(rd)
+
+	var field string
+	signed := false
+	inheader := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "-----BEGIN PGP SIGNED MESSAGE-----" {
+			signed = true
+			inheader = true
+			continue
+		}
+
+		// Skip the armor headers of a signed message
+		if inheader {
+			if len(strings.TrimSpace(line)) == 0 {
+				inheader = false
+			}
+
+			continue
+		}
+
+		if signed && line == "-----BEGIN PGP SIGNATURE-----" {
+			break
+		}
+
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		// Continuation lines
+		if line[0] == ' ' || line[0] == '\t' {
+			if _, ok := dscChecksumFields[field]; !ok {
+				if len(field) != 0 {
+					ret.Fields[field] += "\n" + strings.TrimSpace(line)
+				}
+
+				continue
+			}
+
+			parts := strings.Fields(line)
+
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("Invalid file entry `%s' in %s", strings.TrimSpace(line), field)
+			}
+
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+
+			if err != nil {
+				return nil, fmt.Errorf("Invalid file size `%s' in %s", parts[1], field)
+			}
+
+			ret.Checksums[field] = append(ret.Checksums[field], DscFile{
+				Name:     parts[2],
+				Size:     size,
+				Checksum: strings.ToLower(parts[0]),
+			})
+
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid line `%s'", line)
+		}
+
+		field = kv[0]
+		value := strings.TrimSpace(kv[1])
+
+		switch field {
+		case "Source":
+			ret.Source = value
+		case "Version":
+			ret.Version = value
+		case "Format":
+			ret.Format = value
+		}
+
+		if _, ok := dscChecksumFields[field]; !ok {
+			ret.Fields[field] = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ret.Source) == 0 || len(ret.Version) == 0 {
+		return nil, fmt.Errorf("Missing Source or Version field")
+	}
+
+	if len(ret.Checksums["Files"]) == 0 {
+		return nil, fmt.Errorf("Missing Files field")
+	}
+
+	return ret, nil
+}
+
+func ParseDscFile(filename string) (*Dsc, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	ret, err := ParseDsc(f)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse `%s': %s", path.Base(filename), err)
+	}
+
+	return ret, nil
+}
+
+// Files returns the names of the files referenced by the source package.
+func (x *Dsc) Files() []string {
+	ret := make([]string, 0, len(x.Checksums["Files"]))
+
+	for _, f := range x.Checksums["Files"] {
+		ret = append(ret, f.Name)
+	}
+
+	return ret
+}
+
+// Binaries returns the names of the binary packages built from the source
+// package.
+func (x *Dsc) Binaries() []string {
+	return ParseDependencyNames(x.Fields["Binary"])
+}
+
+// BuildDepends returns the names of the packages the source package
+// build-depends on.
+func (x *Dsc) BuildDepends() []string {
+	return ParseDependencyNames(x.Fields["Build-Depends"] + "," + x.Fields["Build-Depends-Indep"] + "," + x.Fields["Build-Depends-Arch"])
+}
+
+// UpstreamVersion returns the version without epoch and debian revision.
+func (x *Dsc) UpstreamVersion() string {
+	v, err := ParseDebianVersion(x.Version)
+
+	if err != nil {
+		return x.Version
+	}
+
+	return v.Upstream
+}
+
+// Verify checks the sizes and checksums of the referenced files, which
+// are expected in dir.
+func (x *Dsc) Verify(dir string) error {
+	for field, newhash := range dscChecksumFields {
+		for _, f := range x.Checksums[field] {
+			filename := path.Join(dir, f.Name)
+
+			fd, err := os.Open(filename)
+
+			if err != nil {
+				return fmt.Errorf("Missing file `%s' of source package `%s'", f.Name, x.Source)
+			}
+
+			h := newhash()
+			n, err := io.Copy(h, fd)
+			fd.Close()
+
+			if err != nil {
+				return err
+			}
+
+			if n != f.Size {
+				return fmt.Errorf("Size of `%s' does not match (expected %v, got %v)", f.Name, f.Size, n)
+			}
+
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != f.Checksum {
+				return fmt.Errorf("Checksum of `%s' does not match (%s)", f.Name, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isOrigTarball(name string) bool {
+	return strings.Contains(name, ".orig.tar.") || strings.Contains(name, ".orig-")
+}
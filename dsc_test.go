@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testDsc = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+Format: 3.0 (quilt)
+Source: example
+Binary: example, libexample1
+Version: 1:1.0-1
+Build-Depends: debhelper (>= 9), libfoo-dev [amd64] | libbar-dev
+Files:
+ b1946ac92492d2347c6235b4d2611184 6 example_1.0.orig.tar.gz
+Checksums-Sha1:
+ f572d396fae9206628714fb2ce00f72e94f2258f 6 example_1.0.orig.tar.gz
+Checksums-Sha256:
+ 5891B5B522D5DF086D0FF0B110FBD9D21BB4FC7163AF34D08286A2E846F6BE03 6 example_1.0.orig.tar.gz
+
+-----BEGIN PGP SIGNATURE-----
+
+iQEzBAEBCAAdFiEE
+-----END PGP SIGNATURE-----
+`
+
+func TestParseDsc(t *testing.T) {
+	dsc, err := ParseDsc(strings.NewReader(testDsc))
+
+	if err != nil {
+		t.Fatalf("Failed to parse dsc: %s", err)
+	}
+
+	if dsc.Source != "example" || dsc.Version != "1:1.0-1" || dsc.Format != "3.0 (quilt)" {
+		t.Errorf("Unexpected source, version or format: %s %s %s", dsc.Source, dsc.Version, dsc.Format)
+	}
+
+	if v := dsc.UpstreamVersion(); v != "1.0" {
+		t.Errorf("Expected upstream version 1.0, got %s", v)
+	}
+
+	if files := dsc.Files(); len(files) != 1 || files[0] != "example_1.0.orig.tar.gz" {
+		t.Errorf("Unexpected files %v", files)
+	}
+
+	if bins := strings.Join(dsc.Binaries(), " "); bins != "example libexample1" {
+		t.Errorf("Unexpected binaries %s", bins)
+	}
+
+	if deps := strings.Join(dsc.BuildDepends(), " "); deps != "debhelper libfoo-dev libbar-dev" {
+		t.Errorf("Unexpected build dependencies %s", deps)
+	}
+
+	for _, field := range []string{"Files", "Checksums-Sha1", "Checksums-Sha256"} {
+		if len(dsc.Checksums[field]) != 1 {
+			t.Errorf("Expected one entry in %s, got %v", field, len(dsc.Checksums[field]))
+		}
+
+		if _, ok := dsc.Fields[field]; ok {
+			t.Errorf("Checksum field %s should not be in the fields", field)
+		}
+	}
+}
+
+func TestParseDscInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		dsc  string
+	}{
+		{"missing version", "Source: example\nFiles:\n 00 1 a.tar.gz\n"},
+		{"missing files", "Source: example\nVersion: 1.0\n"},
+		{"invalid file entry", "Source: example\nVersion: 1.0\nFiles:\n 00 a.tar.gz\n"},
+		{"invalid file size", "Source: example\nVersion: 1.0\nFiles:\n 00 x a.tar.gz\n"},
+		{"invalid line", "Source: example\nVersion\n"},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseDsc(strings.NewReader(test.dsc)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestDscVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"matching", "hello\n", true},
+		{"different size", "hello world\n", false},
+		{"different checksum", "world\n", false},
+		{"missing", "", false},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "autobuild-dsc")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		if len(test.content) != 0 {
+			if err := ioutil.WriteFile(path.Join(dir, "example_1.0.orig.tar.gz"), []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dsc, err := ParseDsc(strings.NewReader(testDsc))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dsc.Verify(dir)
+
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type AptSource struct {
+	// The sources.list line, e.g. deb http://example.com/debian jammy main
+	Source string `json:"source"`
+
+	// The ASCII armored public key the source is signed with
+	Key string `json:"key,omitempty"`
+}
+
+// BuildEnvironment customizes the build environment of a package. The
+// settings of a distribution (e.g. ubuntu/jammy) and then of a distribution
+// architecture (e.g. ubuntu/jammy/arm64) in Distributions are added to the
+// general settings: lists are extended, environment variables and network
+// access are overridden.
+type BuildEnvironment struct {
+	DebBuildOptions  []string          `json:"deb-build-options,omitempty"`
+	DebBuildProfiles []string          `json:"deb-build-profiles,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+	Packages         []string          `json:"extra-packages,omitempty"`
+	Sources          []AptSource       `json:"apt-sources,omitempty"`
+	Network          *bool             `json:"network,omitempty"`
+
+	Distributions map[string]*BuildEnvironment `json:"distributions,omitempty"`
+}
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var debBuildWordRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.+=:,-]*$`)
+var packageNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*(:[a-z0-9-]+)?([=/][A-Za-z0-9+.~:-]+)?$`)
+
+// Variables set by autobuild, which cannot be set with env
+var reservedEnv = []string{
+	"DIST",
+	"ARCH",
+	"HOST_ARCH",
+	"DEB_BUILD_OPTIONS",
+	"DEB_BUILD_PROFILES",
+}
+
+func (x *BuildEnvironment) merge(other *BuildEnvironment) {
+	x.DebBuildOptions = append(x.DebBuildOptions, other.DebBuildOptions...)
+	x.DebBuildProfiles = append(x.DebBuildProfiles, other.DebBuildProfiles...)
+	x.Packages = append(x.Packages, other.Packages...)
+	x.Sources = append(x.Sources, other.Sources...)
+
+	for k, v := range other.Env {
+		if x.Env == nil {
+			x.Env = make(map[string]string)
+		}
+
+		x.Env[k] = v
+	}
+
+	if other.Network != nil {
+		network := *other.Network
+		x.Network = &network
+	}
+}
+
+// Effective returns the settings for building for arch (or source) of
+// distro.
+func (x *BuildEnvironment) Effective(distro *Distribution, arch string) *BuildEnvironment {
+	ret := &BuildEnvironment{}
+	ret.merge(x)
+
+	for _, name := range []string{distro.SourceName(), distro.BinaryName(arch)} {
+		if d, ok := x.Distributions[name]; ok && d != nil {
+			ret.merge(d)
+		}
+	}
+
+	return ret
+}
+
+func (x *BuildEnvironment) IsEmpty() bool {
+	return len(x.DebBuildOptions) == 0 &&
+		len(x.DebBuildProfiles) == 0 &&
+		len(x.Env) == 0 &&
+		len(x.Packages) == 0 &&
+		len(x.Sources) == 0 &&
+		x.Network == nil
+}
+
+func (x *BuildEnvironment) Validate() error {
+	for k, _ := range x.Env {
+		if !envNameRegex.MatchString(k) {
+			return fmt.Errorf("Invalid environment variable name `%s'", k)
+		}
+
+		if strings.HasPrefix(k, "AUTOBUILD_") {
+			return fmt.Errorf("The environment variable `%s' is reserved", k)
+		}
+
+		for _, r := range reservedEnv {
+			if k == r {
+				return fmt.Errorf("The environment variable `%s' is reserved (use deb-build-options or deb-build-profiles)", k)
+			}
+		}
+
+		if strings.IndexByte(x.Env[k], 0) != -1 {
+			return fmt.Errorf("Invalid value of the environment variable `%s'", k)
+		}
+	}
+
+	// Build options and profiles are the only settings passed to pdebuild
+	// in its environment, so only plain words are allowed
+	for _, w := range append(append([]string{}, x.DebBuildOptions...), x.DebBuildProfiles...) {
+		if !debBuildWordRegex.MatchString(w) {
+			return fmt.Errorf("Invalid build option or profile `%s'", w)
+		}
+	}
+
+	for _, p := range x.Packages {
+		if !packageNameRegex.MatchString(p) {
+			return fmt.Errorf("Invalid extra package `%s'", p)
+		}
+	}
+
+	for _, s := range x.Sources {
+		if strings.ContainsAny(s.Source, "\r\n") || !(strings.HasPrefix(s.Source, "deb ") || strings.HasPrefix(s.Source, "deb-src ")) {
+			return fmt.Errorf("Invalid apt source `%s' (expected a single sources.list line)", s.Source)
+		}
+	}
+
+	return nil
+}
+
+func (x *BuildEnvironment) String() string {
+	ret := make([]string, 0)
+
+	if len(x.DebBuildOptions) != 0 {
+		ret = append(ret, "DEB_BUILD_OPTIONS="+strings.Join(x.DebBuildOptions, " "))
+	}
+
+	if len(x.DebBuildProfiles) != 0 {
+		ret = append(ret, "DEB_BUILD_PROFILES="+strings.Join(x.DebBuildProfiles, " "))
+	}
+
+	names := make([]string, 0, len(x.Env))
+
+	for k, _ := range x.Env {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	for _, k := range names {
+		ret = append(ret, k+"="+x.Env[k])
+	}
+
+	if len(x.Packages) != 0 {
+		ret = append(ret, "extra packages: "+strings.Join(x.Packages, " "))
+	}
+
+	for _, s := range x.Sources {
+		ret = append(ret, "apt source: "+s.Source)
+	}
+
+	if x.Network != nil {
+		if *x.Network {
+			ret = append(ret, "network allowed")
+		} else {
+			ret = append(ret, "network disabled")
+		}
+	}
+
+	return strings.Join(ret, ", ")
+}
+
+// prepareBuildEnvironment determines the build environment settings of a
+// build step and writes the extra apt sources, keys, packages and
+// environment variables to a directory which is bind-mounted in the build
+// environment by pbuilderrc. The D06autobuild-sources and
+// D15autobuild-packages hooks add them to the build environment, and the
+// A10autobuild-env hook sets the environment variables for debian/rules.
+// The environment variables are never set for pdebuild itself, which runs
+// on the host.
+func (x *PackageBuilder) prepareBuildEnvironment(binfo *BuildInfo, info *DistroBuildInfo, distro *Distribution, arch string) error {
+	env := binfo.Package.Options.Environment.Effective(distro, arch)
+
+	if env.IsEmpty() {
+		return nil
+	}
+
+	if err := env.Validate(); err != nil {
+		return err
+	}
+
+	info.Environment = env
+	fmt.Fprintf(info.output, "Build environment: %s\n", env)
+
+	if env.Network != nil && *env.Network {
+		if err := checkPbuilderSupport("network access", "AUTOBUILD_NETWORK"); err != nil {
+			return err
+		}
+	}
+
+	if len(env.Sources) == 0 && len(env.Packages) == 0 && len(env.Env) == 0 {
+		return nil
+	}
+
+	err := checkPbuilderSupport("build environment settings",
+		"AUTOBUILD_ENV_DIR",
+		"A10autobuild-env",
+		"D06autobuild-sources",
+		"D15autobuild-packages")
+
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join(binfo.Package.Dir, "environment", distro.Os, distro.CodeName, arch)
+
+	os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "keys"), 0755)
+
+	sources := make([]string, 0, len(env.Sources))
+
+	for i, s := range env.Sources {
+		sources = append(sources, s.Source)
+
+		if len(s.Key) == 0 {
+			continue
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, "keys", fmt.Sprintf("%v.asc", i)), []byte(s.Key), 0644); err != nil {
+			return err
+		}
+	}
+
+	files := map[string][]string{
+		"sources.list": sources,
+		"packages":     env.Packages,
+		"env":          env.shellEnv(),
+	}
+
+	for name, lines := range files {
+		if len(lines) == 0 {
+			continue
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	info.envdir = dir
+	return nil
+}
+
+// shellEnv returns the environment variables as shell assignments, sorted
+// by name.
+func (x *BuildEnvironment) shellEnv() []string {
+	names := make([]string, 0, len(x.Env))
+
+	for k, _ := range x.Env {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	ret := make([]string, 0, len(names))
+
+	for _, k := range names {
+		ret = append(ret, k+"='"+strings.Replace(x.Env[k], "'", `'\''`, -1)+"'")
+	}
+
+	return ret
+}
+
+// applyBuildEnvironment sets the build environment settings of a build step
+// on a pdebuild command. Only the build options and profiles (which are
+// validated) and the settings used by pbuilderrc are passed, the
+// environment variables of the package are set by the A10autobuild-env
+// hook inside the build environment.
+func (x *PackageBuilder) applyBuildEnvironment(cmd *exec.Cmd, info *DistroBuildInfo) {
+	env := info.Environment
+
+	if env == nil {
+		return
+	}
+
+	if len(env.DebBuildOptions) != 0 {
+		cmd.Env = append(cmd.Env, "DEB_BUILD_OPTIONS="+strings.Join(env.DebBuildOptions, " "))
+	}
+
+	if len(env.DebBuildProfiles) != 0 {
+		cmd.Env = append(cmd.Env, "DEB_BUILD_PROFILES="+strings.Join(env.DebBuildProfiles, " "))
+	}
+
+	if env.Network != nil && *env.Network {
+		cmd.Env = append(cmd.Env, "AUTOBUILD_NETWORK=yes")
+	}
+
+	if len(info.envdir) != 0 {
+		cmd.Env = append(cmd.Env, "AUTOBUILD_ENV_DIR="+info.envdir)
+	}
+}
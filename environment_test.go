@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestBuildEnvironmentValidate(t *testing.T) {
+	tests := []struct {
+		env   BuildEnvironment
+		valid bool
+	}{
+		{BuildEnvironment{Env: map[string]string{"FOO": "bar baz", "_X1": ""}}, true},
+		{BuildEnvironment{Env: map[string]string{"1FOO": "bar"}}, false},
+		{BuildEnvironment{Env: map[string]string{"FOO BAR": "bar"}}, false},
+		{BuildEnvironment{Env: map[string]string{"AUTOBUILD_BASE": "/"}}, false},
+		{BuildEnvironment{Env: map[string]string{"DEB_BUILD_OPTIONS": "nocheck"}}, false},
+		{BuildEnvironment{Env: map[string]string{"FOO": "a\x00b"}}, false},
+		{BuildEnvironment{DebBuildOptions: []string{"nocheck", "parallel=4"}, DebBuildProfiles: []string{"pkg.example.nodoc"}}, true},
+		{BuildEnvironment{DebBuildOptions: []string{"nocheck noopt"}}, false},
+		{BuildEnvironment{DebBuildProfiles: []string{"nodoc\nFOO=bar"}}, false},
+		{BuildEnvironment{Packages: []string{"libfoo-dev", "bar:amd64=1.0-1", "baz/jammy-backports"}}, true},
+		{BuildEnvironment{Packages: []string{"-o=foo"}}, false},
+		{BuildEnvironment{Sources: []AptSource{{Source: "deb http://example.com/ubuntu jammy main"}}}, true},
+		{BuildEnvironment{Sources: []AptSource{{Source: "deb http://example.com/ubuntu jammy main\ndeb http://other jammy main"}}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.env.Validate()
+
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", &test.env, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", &test.env)
+		}
+	}
+}
+
+func TestBuildEnvironmentShellEnv(t *testing.T) {
+	env := &BuildEnvironment{
+		Env: map[string]string{
+			"QUOTED": `it's "quoted" $HOME $(true) \`,
+			"EMPTY":  "",
+			"LINES":  "a\nb",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "autobuild-env")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "env")
+
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(env.shellEnv(), "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Source the variables like the A10autobuild-env hook does
+	out, err := exec.Command("/bin/sh", "-c", `set -a; . "$1"; set +a; printf '%s|%s|%s' "$EMPTY" "$LINES" "$QUOTED"`, "sh", filename).Output()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "|" + env.Env["LINES"] + "|" + env.Env["QUOTED"]
+
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(out))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"syscall"
 )
 
 func prepareCommand(name string, arg ...string) *exec.Cmd {
@@ -66,3 +67,11 @@ func MakeCommandIn(wd string, name string, arg ...string) *exec.Cmd {
 
 	return ret
 }
+
+func KillCommandGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
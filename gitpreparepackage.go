@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"regexp"
 	"strings"
 	"time"
 )
@@ -15,7 +14,7 @@ import (
 type CommandGitPreparePackage struct {
 }
 
-func (x *CommandGitPreparePackage) updateChangelog(name string, version string) error {
+func (x *CommandGitPreparePackage) updateChangelog(name string, version *DebianVersion) error {
 	f, err := os.Open("debian/changelog")
 
 	if err != nil {
@@ -46,7 +45,7 @@ func (x *CommandGitPreparePackage) updateChangelog(name string, version string)
 
 	emails := strings.TrimSpace(string(email))
 
-	ch := fmt.Sprintf("%s (%s-1) UNRELEASED; urgency=low\n\n  * \n\n -- %s <%s>  %s\n\n",
+	ch := fmt.Sprintf("%s (%s) UNRELEASED; urgency=low\n\n  * \n\n -- %s <%s>  %s\n\n",
 		name, version, users, emails, date) + string(changelog)
 
 	f, err = os.Create("debian/changelog")
@@ -74,7 +73,7 @@ func (x *CommandGitPreparePackage) updateChangelog(name string, version string)
 		return err
 	}
 
-	cmd = MakeInheritedCommand("git", "commit", "-e", "-m", fmt.Sprintf("Release version %s", version))
+	cmd = MakeInheritedCommand("git", "commit", "-e", "-m", fmt.Sprintf("Release version %s", version.Upstream))
 
 	if err := cmd.Run(); err != nil {
 		return err
@@ -112,7 +111,7 @@ func (x *CommandGitPreparePackage) Execute(args []string) error {
 		return fmt.Errorf("Please provide one tarball of a package (e.g. made with 'make distcheck')")
 	}
 
-	matched := packageInfoRegex.FindStringSubmatch(args[0])
+	matched := packageInfoRegex.FindStringSubmatch(path.Base(args[0]))
 
 	if matched == nil {
 		return fmt.Errorf("The package `%s' does not appear to be a package...", args[0])
@@ -120,7 +119,11 @@ func (x *CommandGitPreparePackage) Execute(args []string) error {
 
 	name := matched[1]
 	version := matched[2]
-	compression := matched[4]
+	compression := matched[3]
+
+	if _, err := ParseDebianVersion(version); err != nil {
+		return err
+	}
 
 	f, err := os.Open("debian/changelog")
 
@@ -137,15 +140,20 @@ func (x *CommandGitPreparePackage) Execute(args []string) error {
 
 	f.Close()
 
-	chm, _ := regexp.Compile(`^([^\s]+)\s+\(([0-9]+(\.[0-9]+)+)-[0-9]\)`)
-	matched = chm.FindStringSubmatch(line)
+	header := ParseChangelogHeader(line)
 
-	if matched == nil {
+	if header == nil {
 		return fmt.Errorf("Failed to extract version information from debian changelog")
 	}
 
-	if matched[2] != version {
-		if err := x.updateChangelog(matched[1], version); err != nil {
+	if header.Version.Upstream != version {
+		newversion := &DebianVersion{
+			Epoch:    header.Version.Epoch,
+			Upstream: version,
+			Revision: "1",
+		}
+
+		if err := x.updateChangelog(header.Name, newversion); err != nil {
 			return err
 		}
 	}
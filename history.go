@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type CommandHistory struct {
+	Package      string `short:"p" long:"package" description:"Only show builds of this package"`
+	Distribution string `short:"d" long:"distribution" description:"Only show builds for this distribution (e.g. ubuntu, ubuntu/precise or ubuntu/precise/amd64)"`
+	User         string `short:"u" long:"user" description:"Only show builds staged by this user"`
+	Status       string `short:"s" long:"status" description:"Only show builds with this status (built, failed, timeout, cancelled, released or discarded)"`
+	Since        string `long:"since" description:"Only show builds since this date (YYYY-MM-DD)"`
+	Until        string `long:"until" description:"Only show builds until this date (YYYY-MM-DD)"`
+
+	Notifications bool `short:"n" long:"notifications" description:"Show the deliveries of notifications of your packages instead of builds"`
+}
+
+func (x *CommandHistory) parseDate(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+
+	if err != nil {
+		return t, fmt.Errorf("Invalid date `%s' (use YYYY-MM-DD)", s)
+	}
+
+	return t, nil
+}
+
+func (x *CommandHistory) showNotifications() error {
+	a := &Notifications{
+		Package: x.Package,
+	}
+
+	ret := &NotificationsReply{}
+
+	if err := RemoteCall("DaemonCommands.Notifications", a, ret); err != nil {
+		return err
+	}
+
+	if len(ret.Records) == 0 {
+		fmt.Println("There are no notifications...")
+		return nil
+	}
+
+	for _, r := range ret.Records {
+		status := "delivered"
+
+		if !r.Delivered {
+			status = "failed"
+		}
+
+		fmt.Printf("%s  %5d  %s %s  %s  %s  %s [attempt %d]\n",
+			r.Time.Local().Format("2006-01-02 15:04"),
+			r.PackageId,
+			r.Package,
+			r.Version,
+			r.Event,
+			r.Target,
+			status,
+			r.Attempt)
+
+		if len(r.Error) != 0 {
+			fmt.Printf("       %s\n", r.Error)
+		}
+	}
+
+	return nil
+}
+
+func (x *CommandHistory) Execute(args []string) error {
+	if x.Notifications {
+		return x.showNotifications()
+	}
+
+	since, err := x.parseDate(x.Since)
+
+	if err != nil {
+		return err
+	}
+
+	until, err := x.parseDate(x.Until)
+
+	if err != nil {
+		return err
+	}
+
+	// Include the whole day
+	if !until.IsZero() {
+		until = until.Add(24 * time.Hour)
+	}
+
+	a := &History{
+		Filter: HistoryFilter{
+			Package:      x.Package,
+			Distribution: x.Distribution,
+			User:         x.User,
+			Status:       x.Status,
+			Since:        since,
+			Until:        until,
+		},
+	}
+
+	ret := &HistoryReply{}
+
+	if err := RemoteCall("DaemonCommands.History", a, ret); err != nil {
+		return err
+	}
+
+	if len(ret.Records) == 0 {
+		fmt.Println("There are no builds matching the specified filters...")
+		return nil
+	}
+
+	for _, r := range ret.Records {
+		distro := r.Distribution
+
+		if len(distro) == 0 {
+			distro = "-"
+		}
+
+		fmt.Printf("%s  %5d  %s %s  %s  %s  %s",
+			r.Time.Local().Format("2006-01-02 15:04"),
+			r.Id,
+			r.Name,
+			r.Version,
+			distro,
+			r.Owner,
+			r.Status)
+
+		if r.Duration != 0 {
+			fmt.Printf(" (%v)", r.Duration-r.Duration%time.Second)
+		}
+
+		if r.Retries != 0 {
+			fmt.Printf(" [retry %d]", r.Retries)
+		}
+
+		if r.Automatic {
+			fmt.Printf(" [automatic]")
+		}
+
+		fmt.Println()
+
+		if len(r.Error) != 0 && r.Status != HistoryReleased && r.Status != HistoryDiscarded {
+			fmt.Printf("       %s\n", r.Error)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	parser.AddCommand("history",
+		"Show the history of built packages",
+		"The history command shows a record of every build made by the build daemon: what was built, by whom, when, how long it took and whether it was released or discarded. The records can be filtered by package name (-p, --package), distribution (-d, --distribution), user (-u, --user), status (-s, --status) and date (--since, --until).",
+		&CommandHistory{})
+}
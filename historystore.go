@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HistoryBuilt     = "built"
+	HistoryFailed    = "failed"
+	HistoryTimeout   = "timeout"
+	HistoryCancelled = "cancelled"
+	HistorySkipped   = "skipped"
+	HistoryReleased  = "released"
+	HistoryDiscarded = "discarded"
+)
+
+type HistoryRecord struct {
+	Time      time.Time
+	PackageId uint64
+	Id        uint64
+
+	Name         string
+	Version      string
+	Uid          uint32
+	Owner        string
+	Distribution string
+
+	Status   string
+	Error    string `json:",omitempty"`
+	Retries  int    `json:",omitempty"`
+	Started  time.Time
+	Finished time.Time
+	Duration time.Duration
+
+	// Whether the build was released by a release policy
+	Automatic bool `json:",omitempty"`
+}
+
+type HistoryFilter struct {
+	Package      string
+	Distribution string
+	User         string
+	Status       string
+	Since        time.Time
+	Until        time.Time
+}
+
+type HistoryStore struct {
+	mutex sync.Mutex
+}
+
+var history HistoryStore
+
+func (x *HistoryFilter) Matches(r *HistoryRecord) bool {
+	if len(x.Package) != 0 && x.Package != r.Name {
+		return false
+	}
+
+	if len(x.Distribution) != 0 && r.Distribution != x.Distribution && !strings.HasPrefix(r.Distribution, x.Distribution+"/") {
+		return false
+	}
+
+	if len(x.User) != 0 && x.User != r.Owner && x.User != fmt.Sprintf("%v", r.Uid) {
+		return false
+	}
+
+	if len(x.Status) != 0 && x.Status != r.Status {
+		return false
+	}
+
+	if !x.Since.IsZero() && r.Time.Before(x.Since) {
+		return false
+	}
+
+	if !x.Until.IsZero() && r.Time.After(x.Until) {
+		return false
+	}
+
+	return true
+}
+
+func (x *HistoryStore) filename() string {
+	return path.Join(options.Base, "history", "builds.json")
+}
+
+// Append adds records to the end of the history. Records are never
+// modified once written.
+func (x *HistoryStore) Append(records []*HistoryRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	filename := x.filename()
+	os.MkdirAll(path.Dir(filename), 0755)
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *HistoryStore) Query(filter *HistoryFilter) ([]*HistoryRecord, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	ret := make([]*HistoryRecord, 0)
+
+	f, err := os.Open(x.filename())
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		r := &HistoryRecord{}
+
+		// Skip records which were not completely written
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue
+		}
+
+		if filter.Matches(r) {
+			ret = append(ret, r)
+		}
+	}
+
+	return ret, scanner.Err()
+}
+
+func makeHistoryRecord(binfo *BuildInfo, info *DistroBuildInfo, status string) *HistoryRecord {
+	owner := fmt.Sprintf("%v", binfo.Info.Uid)
+
+	if us, err := user.LookupId(owner); err == nil {
+		owner = us.Username
+	}
+
+	r := &HistoryRecord{
+		Time:      time.Now(),
+		PackageId: binfo.Info.Id,
+		Name:      binfo.Info.Name,
+		Version:   binfo.Info.Version,
+		Uid:       binfo.Info.Uid,
+		Owner:     owner,
+		Status:    status,
+		Started:   binfo.Started,
+		Finished:  binfo.Finished,
+	}
+
+	err := binfo.Error
+
+	if info != nil {
+		d := info.Distribution
+
+		r.Id = info.Id
+		r.Distribution = d.BinaryName(d.Architectures[0])
+		r.Started = info.Started
+		r.Finished = info.Finished
+		r.Retries = info.Retries
+
+		err = info.Error
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if !r.Started.IsZero() && !r.Finished.IsZero() {
+		r.Duration = r.Finished.Sub(r.Started)
+	}
+
+	return r
+}
+
+func buildStatus(err error, timedout bool) string {
+	if err == nil {
+		return HistoryBuilt
+	} else if timedout {
+		return HistoryTimeout
+	} else if err == ErrBuildCancelled {
+		return HistoryCancelled
+	} else if err == ErrBuildSkipped {
+		return HistorySkipped
+	}
+
+	return HistoryFailed
+}
+
+func (x *PackageBuilder) recordStep(binfo *BuildInfo, info *DistroBuildInfo) {
+	r := makeHistoryRecord(binfo, info, buildStatus(info.Error, info.TimedOut))
+
+	if err := history.Append([]*HistoryRecord{r}); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record build history: %s\n", err)
+	}
+}
+
+func (x *PackageBuilder) recordFinished(binfo *BuildInfo) {
+	// Build steps are recorded as they finish, only record packages which
+	// failed before building anything
+	if len(binfo.Packages) != 0 {
+		return
+	}
+
+	r := makeHistoryRecord(binfo, nil, buildStatus(binfo.Error, false))
+
+	if err := history.Append([]*HistoryRecord{r}); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record build history: %s\n", err)
+	}
+}
+
+func (x *PackageBuilder) recordDisposition(records []*HistoryRecord) {
+	if err := history.Append(records); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record build history: %s\n", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Hooks run at the phases of a build. Hooks are the executable files in
+// etc/hooks/<phase>.d/ (run in order of their names), followed by the
+// commands configured for the phase in the "hooks" configuration (run with
+// /bin/sh -c). A failing pre hook fails the step (or refuses the release or
+// discard of the build), failing post hooks are only reported.
+const (
+	HookPreExtract  = "pre-extract"
+	HookPreSource   = "pre-source"
+	HookPostSource  = "post-source"
+	HookPreBinary   = "pre-binary"
+	HookPostBinary  = "post-binary"
+	HookPreRelease  = "pre-release"
+	HookPostRelease = "post-release"
+	HookPreDiscard  = "pre-discard"
+	HookPostDiscard = "post-discard"
+)
+
+// The environment of hooks
+const hookEnvironment = `AUTOBUILD_HOOK (the phase), AUTOBUILD_BASE, AUTOBUILD_PACKAGE, AUTOBUILD_VERSION, AUTOBUILD_STAGE_FILE, AUTOBUILD_OWNER, AUTOBUILD_UID, AUTOBUILD_PACKAGE_ID and, for steps of a distribution, AUTOBUILD_ID, AUTOBUILD_DISTRIBUTION (e.g. ubuntu/precise), AUTOBUILD_ARCH (source for source packages) and after building AUTOBUILD_RESULT (ok, failed or timeout), AUTOBUILD_ERROR, AUTOBUILD_CHANGES and AUTOBUILD_FILES (space separated)`
+
+func hookCommands(phase string) []*exec.Cmd {
+	ret := make([]*exec.Cmd, 0)
+
+	hookdir := path.Join(options.Base, "etc", "hooks", phase+".d")
+
+	if f, err := os.Open(hookdir); err == nil {
+		names, _ := f.Readdirnames(0)
+		f.Close()
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			filename := path.Join(hookdir, name)
+			fi, err := os.Stat(filename)
+
+			// Skip editor backups and non executable files
+			if err != nil || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 || strings.HasSuffix(name, "~") {
+				continue
+			}
+
+			ret = append(ret, exec.Command(filename))
+		}
+	}
+
+	for _, command := range options.Hooks[phase] {
+		ret = append(ret, exec.Command("/bin/sh", "-c", command))
+	}
+
+	return ret
+}
+
+func hookEnv(phase string, binfo *BuildInfo, info *DistroBuildInfo) []string {
+	owner := fmt.Sprintf("%v", binfo.Info.Uid)
+
+	if us, err := user.LookupId(owner); err == nil {
+		owner = us.Username
+	}
+
+	env := []string{
+		"AUTOBUILD_HOOK=" + phase,
+		"AUTOBUILD_BASE=" + options.Base,
+		"AUTOBUILD_PACKAGE=" + binfo.Info.Name,
+		"AUTOBUILD_VERSION=" + binfo.Info.Version,
+		"AUTOBUILD_STAGE_FILE=" + binfo.Info.StageFile,
+		"AUTOBUILD_OWNER=" + owner,
+		fmt.Sprintf("AUTOBUILD_UID=%v", binfo.Info.Uid),
+		fmt.Sprintf("AUTOBUILD_PACKAGE_ID=%v", binfo.Info.Id),
+	}
+
+	if info == nil {
+		return env
+	}
+
+	d := info.Distribution
+
+	env = append(env,
+		fmt.Sprintf("AUTOBUILD_ID=%v", info.Id),
+		"AUTOBUILD_DISTRIBUTION="+d.SourceName(),
+		"AUTOBUILD_ARCH="+d.Architectures[0])
+
+	if strings.HasPrefix(phase, "post-") || phase == HookPreRelease || phase == HookPreDiscard {
+		result := "ok"
+
+		if info.TimedOut {
+			result = "timeout"
+		} else if info.Error != nil {
+			result = "failed"
+			env = append(env, "AUTOBUILD_ERROR="+info.Error.Error())
+		}
+
+		env = append(env,
+			"AUTOBUILD_RESULT="+result,
+			"AUTOBUILD_FILES="+strings.Join(info.Files, " "))
+
+		if len(info.Changes) != 0 {
+			env = append(env, "AUTOBUILD_CHANGES="+info.Changes+".changes")
+		}
+	}
+
+	return env
+}
+
+// runHooks runs the hooks of a phase, writing their output to output. Hooks
+// of build steps (run is non nil) are run like build commands, so that they
+// are terminated when the build is cancelled.
+func runHooks(phase string, binfo *BuildInfo, info *DistroBuildInfo, output io.Writer, run func(cmd *exec.Cmd) error) error {
+	for _, cmd := range hookCommands(phase) {
+		cmd.Dir = options.Base
+		cmd.Env = append(os.Environ(), hookEnv(phase, binfo, info)...)
+		cmd.Stdout = output
+		cmd.Stderr = output
+
+		if options.Verbose {
+			fmt.Printf("Running %s hook %s\n", phase, cmd.Args)
+		}
+
+		var err error
+
+		if run != nil {
+			err = run(cmd)
+		} else {
+			err = cmd.Run()
+		}
+
+		if err != nil {
+			return fmt.Errorf("The %s hook %s failed: %s", phase, cmd.Args, err)
+		}
+	}
+
+	return nil
+}
+
+// runStepHooks runs the hooks of a phase for a build step, capturing their
+// output in the build log of the step.
+func (x *PackageBuilder) runStepHooks(phase string, binfo *BuildInfo, info *DistroBuildInfo) error {
+	return runHooks(phase, binfo, info, info.output, func(cmd *exec.Cmd) error {
+		return x.runBuildCommand(binfo, cmd, 0)
+	})
+}
+
+// runPostStepHooks runs the post hooks of a build step. Failures are noted
+// in the build log, but do not fail the step.
+func (x *PackageBuilder) runPostStepHooks(phase string, binfo *BuildInfo, info *DistroBuildInfo) {
+	if err := x.runStepHooks(phase, binfo, info); err != nil {
+		fmt.Fprintf(info.output, "%s\n", err)
+	}
+}
+
+// runCapturedHooks runs hooks outside of a build step (extracting, releasing
+// or discarding). The output of failing hooks is part of the returned error.
+func runCapturedHooks(phase string, binfo *BuildInfo, info *DistroBuildInfo) error {
+	var output bytes.Buffer
+
+	if err := runHooks(phase, binfo, info, &output, nil); err != nil {
+		if out := strings.TrimSpace(output.String()); len(out) != 0 {
+			return fmt.Errorf("%s:\n%s", err, out)
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -9,11 +9,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"runtime"
 	"strings"
 )
 
 type CommandInit struct {
+	Cross bool `short:"c" long:"cross" description:"Cross-build the specified architectures in the build environment of the host architecture"`
 }
 
 func (x *CommandInit) addDistro(distro *Distribution, arch string) error {
@@ -225,12 +225,8 @@ func ParseDistributions(args []string) ([]*Distribution, error) {
 
 		if len(parts) > 2 {
 			d.Architectures = []string{parts[2]}
-		} else if runtime.GOARCH == "386" {
-			d.Architectures = []string{"i386"}
-		} else if runtime.GOARCH == "amd64" {
-			d.Architectures = []string{"amd64"}
-		} else if runtime.GOARCH == "arm" {
-			d.Architectures = []string{"arm"}
+		} else if arch, err := hostArchitecture(); err == nil {
+			d.Architectures = []string{arch}
 		}
 
 		distros = append(distros, d)
@@ -268,6 +264,14 @@ func (x *CommandInit) Execute(args []string) error {
 		distvar := fmt.Sprintf("DIST=%s/%s", distro.Os, distro.CodeName)
 
 		for _, arch := range distro.Architectures {
+			if x.Cross {
+				if err := x.initCross(distro, arch); err != nil {
+					return err
+				}
+
+				continue
+			}
+
 			if err = x.AddDistribution(distro, arch); err != nil {
 				return err
 			}
@@ -308,6 +312,6 @@ func (x *CommandInit) Execute(args []string) error {
 func init() {
 	parser.AddCommand("init",
 		"Initialize a new build environment for a specific distribution",
-		"The init command initializes a new debootstrap build environment for a specific distribution. The arguments to the command specify which distributions to initialize and has the following syntax: <dist>/<codename>[/<arch>], where <dist> is the distribution (e.g. ubuntu or debian), <codename> is the distribution codename (e.g. precise or wheezy) and the optional <arch> is the architecture (e.g. i386 or amd64). If <arch> is not specified the architecture of the host machine will be used.",
+		"The init command initializes a new debootstrap build environment for a specific distribution. The arguments to the command specify which distributions to initialize and has the following syntax: <dist>/<codename>[/<arch>], where <dist> is the distribution (e.g. ubuntu or debian), <codename> is the distribution codename (e.g. precise or wheezy) and the optional <arch> is the architecture (e.g. i386 or amd64). If <arch> is not specified the architecture of the host machine will be used. With -c, --cross, the specified architectures (e.g. ubuntu/jammy/arm64) are cross-built instead: no build environment is created for them, and their packages are built in the build environment of the host architecture (which needs to be initialized first) with dpkg-buildpackage --host-arch, installing the build dependencies for the target architecture. Cross-built packages are not tested (see the \"tests\" build option).",
 		&CommandInit{})
 }
@@ -13,6 +13,53 @@ import (
 type CommandInstall struct {
 }
 
+// The pbuilder hooks installed in pbuilder/hooks
+var pbuilderHooks = []string{
+	"A10autobuild-env",
+	"A20autobuild-vary",
+	"D04autobuild-cross",
+	"D05autobuild-local",
+	"D06autobuild-sources",
+	"D10apt-get-update",
+	"D15autobuild-packages",
+}
+
+func installPbuilderHook(name string) error {
+	hook := path.Join(options.Base, "pbuilder", "hooks", name)
+
+	WriteResource(name, hook)
+	return os.Chmod(hook, 0755)
+}
+
+// checkPbuilderSupport checks that an installation from before a feature
+// was added supports it. Missing hooks of the feature are installed, but
+// etc/pbuilderrc (which may have been customized) is only checked for the
+// variable used by the feature, e.g. AUTOBUILD_LOCAL_REPO.
+func checkPbuilderSupport(feature string, variable string, hooks ...string) error {
+	rc := path.Join(options.Base, "etc", "pbuilderrc")
+	data, err := ioutil.ReadFile(rc)
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(string(data), variable) {
+		return fmt.Errorf("The pbuilder configuration `%s' does not support %s yet, please run `autobuild install' to update it", rc, feature)
+	}
+
+	for _, name := range hooks {
+		if _, err := os.Stat(path.Join(options.Base, "pbuilder", "hooks", name)); err == nil {
+			continue
+		}
+
+		if err := installPbuilderHook(name); err != nil {
+			return fmt.Errorf("Failed to install the pbuilder hook `%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
+
 func (x *CommandInstall) makeGroup() (int, error) {
 	if len(options.Group) == 0 {
 		return 0, nil
@@ -446,11 +493,9 @@ func (x *CommandInstall) Execute(args []string) error {
 
 	WriteResource("pbuilderrc", path.Join(options.Base, "etc", "pbuilderrc"))
 
-	updatehook := path.Join(options.Base, "pbuilder", "hooks", "D10apt-get-update")
-	WriteResource("D10apt-get-update", updatehook)
-
-	// Make hook executable
-	os.Chmod(updatehook, 0755)
+	for _, name := range pbuilderHooks {
+		installPbuilderHook(name)
+	}
 
 	// Create dirs
 	for _, dir := range []string{"repository", "pbuilder"} {
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+type LintianOptions struct {
+	// Check the results of binary builds with lintian
+	Enabled bool `json:"enabled"`
+
+	// Releasing is blocked when a build has more tags of a severity than
+	// allowed. Negative values allow any number of tags.
+	MaxErrors   int `json:"max-errors"`
+	MaxWarnings int `json:"max-warnings"`
+	MaxInfo     int `json:"max-info"`
+}
+
+type LintianTag struct {
+	Severity string
+	Package  string
+	Tag      string
+	Info     string `json:",omitempty"`
+}
+
+type LintianResult struct {
+	Tags   []LintianTag
+	Counts map[string]int
+
+	// Set when lintian could not check the build
+	Error string `json:",omitempty"`
+
+	// Set when the release of the build is blocked
+	Blocked string `json:",omitempty"`
+}
+
+var lintianSeverities = map[string]string{
+	"E": "error",
+	"W": "warning",
+	"I": "info",
+	"P": "pedantic",
+	"X": "experimental",
+	"O": "overridden",
+	"C": "classification",
+}
+
+const lintianScript = `#!/bin/bash
+
+# Install lintian in the build environment and check a .changes file
+apt-get install -y lintian 1>&2 || exit 1
+
+lintian --no-tag-display-limit "$2" > "$1/lintian.out"
+
+# lintian exits with 1 when it emitted tags
+[ $? -le 1 ]
+`
+
+// ParseLintian parses lintian output lines of the form
+// `W: example source: tag-name extra info'.
+func ParseLintian(output []byte) *LintianResult {
+	ret := &LintianResult{
+		Counts: make(map[string]int),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) < 3 || line[1:3] != ": " {
+			continue
+		}
+
+		severity, ok := lintianSeverities[line[:1]]
+
+		if !ok {
+			continue
+		}
+
+		rest := line[3:]
+		i := strings.Index(rest, ": ")
+
+		if i == -1 {
+			continue
+		}
+
+		parts := strings.SplitN(rest[i+2:], " ", 2)
+
+		tag := LintianTag{
+			Severity: severity,
+			Package:  rest[:i],
+			Tag:      parts[0],
+		}
+
+		if len(parts) == 2 {
+			tag.Info = parts[1]
+		}
+
+		ret.Tags = append(ret.Tags, tag)
+		ret.Counts[severity]++
+	}
+
+	return ret
+}
+
+// restrict returns the lintian options of the daemon configuration,
+// restricted by the options of a package. A package can enable lintian and
+// lower the limits, but it cannot disable lintian or raise the limits.
+func (x *LintianOptions) restrict(pkg *LintianOptions) *LintianOptions {
+	return &LintianOptions{
+		Enabled:     x.Enabled || pkg.Enabled,
+		MaxErrors:   lowestLimit(x.MaxErrors, pkg.MaxErrors),
+		MaxWarnings: lowestLimit(x.MaxWarnings, pkg.MaxWarnings),
+		MaxInfo:     lowestLimit(x.MaxInfo, pkg.MaxInfo),
+	}
+}
+
+// lowestLimit returns the lowest of two limits, of which negative values
+// are unlimited.
+func lowestLimit(a int, b int) int {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+func (x *LintianResult) check(opts *LintianOptions) {
+	x.Blocked = ""
+
+	if len(x.Error) != 0 {
+		x.Blocked = "lintian failed: " + x.Error
+		return
+	}
+
+	limits := []struct {
+		severity string
+		max      int
+	}{
+		{"error", opts.MaxErrors},
+		{"warning", opts.MaxWarnings},
+		{"info", opts.MaxInfo},
+	}
+
+	for _, l := range limits {
+		if l.max >= 0 && x.Counts[l.severity] > l.max {
+			x.Blocked = fmt.Sprintf("%v lintian %s tags (at most %v allowed)", x.Counts[l.severity], l.severity, l.max)
+			return
+		}
+	}
+}
+
+func (x *LintianResult) String() string {
+	ret := fmt.Sprintf("%v errors, %v warnings, %v info",
+		x.Counts["error"],
+		x.Counts["warning"],
+		x.Counts["info"])
+
+	if len(x.Blocked) != 0 {
+		ret += fmt.Sprintf(" (release blocked: %s)", x.Blocked)
+	}
+
+	return ret
+}
+
+// runLintian checks the .changes file of a successful binary build with
+// lintian in the build environment of the distribution. The output is
+// appended to the build log.
+func (x *PackageBuilder) runLintian(binfo *BuildInfo, info *DistroBuildInfo, distro *Distribution, arch string) {
+	opts := options.BuildOptions.Lintian.restrict(&binfo.Package.Options.Lintian)
+
+	if !opts.Enabled || len(info.Changes) == 0 {
+		return
+	}
+
+	outdir := path.Join(binfo.Package.Dir, "lintian", distro.Os, distro.CodeName, arch)
+
+	os.RemoveAll(outdir)
+	os.MkdirAll(outdir, 0755)
+
+	script := path.Join(outdir, "lintian.sh")
+
+	info.Lintian = &LintianResult{
+		Counts: make(map[string]int),
+	}
+
+	// Cross-built packages are checked in the environment of the host
+	chrootarch, err := chrootArchitecture(distro, arch)
+
+	if err != nil {
+		info.Lintian.Error = err.Error()
+		info.Lintian.check(opts)
+		return
+	}
+
+	if err := ioutil.WriteFile(script, []byte(lintianScript), 0755); err != nil {
+		info.Lintian.Error = err.Error()
+		info.Lintian.check(opts)
+		return
+	}
+
+	fmt.Fprintf(info.output, "\nRunning lintian on %s.changes...\n", path.Base(info.Changes))
+
+	cmd := MakeCommandIn(outdir,
+		options.Pbuilder,
+		"--execute",
+		"--configfile", path.Join(options.Base, "etc", "pbuilderrc"),
+		"--bindmounts", outdir+" "+info.IncomingDir,
+		"--",
+		script,
+		outdir,
+		info.Changes+".changes")
+
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("DIST=%s/%s", distro.Os, distro.CodeName))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("ARCH=%s", chrootarch))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("AUTOBUILD_BASE=%s", options.Base))
+
+	cmd.Stdout = info.output
+	cmd.Stderr = info.output
+
+	err = x.runBuildCommand(binfo, cmd, binfo.Package.Timeout(distro, TimeoutBinary))
+
+	if err == nil {
+		var out []byte
+
+		if out, err = ioutil.ReadFile(path.Join(outdir, "lintian.out")); err == nil {
+			info.output.Write(out)
+			info.Lintian = ParseLintian(out)
+		}
+	}
+
+	if err != nil {
+		info.Lintian.Error = err.Error()
+	}
+
+	info.Lintian.check(opts)
+
+	fmt.Fprintf(info.output, "Lintian: %s\n", info.Lintian)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLintian(t *testing.T) {
+	output := `E: example: binary-without-manpage usr/bin/example
+W: example source: ancient-standards-version 3.9.8 (released 2016-04-06)
+W: libexample1: package-name-doesnt-match-sonames libexample0
+I: example: spelling-error-in-description
+N: a note which is not a tag
+O: example: hardening-no-fortify-functions usr/bin/example
+garbage
+X:no separator
+E: no package separator
+`
+
+	result := ParseLintian([]byte(output))
+
+	expected := []LintianTag{
+		{"error", "example", "binary-without-manpage", "usr/bin/example"},
+		{"warning", "example source", "ancient-standards-version", "3.9.8 (released 2016-04-06)"},
+		{"warning", "libexample1", "package-name-doesnt-match-sonames", "libexample0"},
+		{"info", "example", "spelling-error-in-description", ""},
+		{"overridden", "example", "hardening-no-fortify-functions", "usr/bin/example"},
+	}
+
+	if len(result.Tags) != len(expected) {
+		t.Fatalf("Expected %v tags, got %v: %v", len(expected), len(result.Tags), result.Tags)
+	}
+
+	for i, tag := range expected {
+		if result.Tags[i] != tag {
+			t.Errorf("Tag %v: expected %v, got %v", i, tag, result.Tags[i])
+		}
+	}
+
+	counts := map[string]int{
+		"error":      1,
+		"warning":    2,
+		"info":       1,
+		"overridden": 1,
+	}
+
+	for severity, n := range counts {
+		if result.Counts[severity] != n {
+			t.Errorf("Expected %v %s tags, got %v", n, severity, result.Counts[severity])
+		}
+	}
+}
+
+func TestLintianResultCheck(t *testing.T) {
+	result := &LintianResult{
+		Counts: map[string]int{"error": 1, "warning": 3},
+	}
+
+	tests := []struct {
+		opts    LintianOptions
+		blocked bool
+	}{
+		{LintianOptions{MaxErrors: 1, MaxWarnings: 3, MaxInfo: 0}, false},
+		{LintianOptions{MaxErrors: 0, MaxWarnings: -1, MaxInfo: -1}, true},
+		{LintianOptions{MaxErrors: -1, MaxWarnings: 2, MaxInfo: -1}, true},
+		{LintianOptions{MaxErrors: -1, MaxWarnings: -1, MaxInfo: -1}, false},
+	}
+
+	for _, test := range tests {
+		result.Blocked = ""
+		result.check(&test.opts)
+
+		if blocked := len(result.Blocked) != 0; blocked != test.blocked {
+			t.Errorf("%+v: expected blocked %v, got `%s'", test.opts, test.blocked, result.Blocked)
+		}
+	}
+}
+
+func TestLintianOptionsRestrict(t *testing.T) {
+	tests := []struct {
+		daemon   LintianOptions
+		pkg      LintianOptions
+		expected LintianOptions
+	}{
+		{LintianOptions{true, 0, -1, -1}, LintianOptions{false, -1, -1, -1}, LintianOptions{true, 0, -1, -1}},
+		{LintianOptions{false, 0, -1, -1}, LintianOptions{true, 0, 10, -1}, LintianOptions{true, 0, 10, -1}},
+		{LintianOptions{true, 2, 10, 5}, LintianOptions{true, 5, 3, -1}, LintianOptions{true, 2, 3, 5}},
+		{LintianOptions{true, -1, -1, -1}, LintianOptions{false, 1, 0, -1}, LintianOptions{true, 1, 0, -1}},
+	}
+
+	for _, test := range tests {
+		if opts := test.daemon.restrict(&test.pkg); *opts != test.expected {
+			t.Errorf("%+v restricted by %+v: expected %+v, got %+v", test.daemon, test.pkg, test.expected, *opts)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// localDependencies returns the binary packages (.deb) for distro and arch
+// of finished, not yet released packages which the package build-depends
+// on.
+func (x *PackageBuilder) localDependencies(binfo *BuildInfo, distro *Distribution, arch string) []string {
+	var ret []string
+
+	x.Do(func(b *PackageBuilder) error {
+		for _, finished := range b.FinishedPackages {
+			if !binfo.Info.DependsOn(finished.Info) {
+				continue
+			}
+
+			for _, step := range finished.Packages {
+				d := step.Distribution
+
+				if step.Error != nil || d.Os != distro.Os || d.CodeName != distro.CodeName {
+					continue
+				}
+
+				for _, f := range step.ChangesFiles {
+					if strings.HasSuffix(f, "_"+arch+".deb") || strings.HasSuffix(f, "_all.deb") {
+						ret = append(ret, f)
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return ret
+}
+
+// prepareLocalRepository creates a temporary apt repository containing the
+// just built dependencies of the package, when enabled in the build options.
+// It returns the directory of the repository, or an empty string if there
+// are no such dependencies. The repository is bind-mounted in the build
+// environment by pbuilderrc and added to the apt sources by the
+// D05autobuild-local hook.
+func (x *PackageBuilder) prepareLocalRepository(binfo *BuildInfo, distro *Distribution, arch string) (string, error) {
+	if !binfo.Package.Options.LocalDependencies {
+		return "", nil
+	}
+
+	dir := path.Join(binfo.Package.Dir, "local", distro.Os, distro.CodeName, arch)
+
+	// Source packages are built in the environment of the host
+	// architecture, like pbuilderrc does
+	if arch == "source" {
+		var err error
+
+		if arch, err = hostArchitecture(); err != nil {
+			return "", err
+		}
+	}
+
+	debs := x.localDependencies(binfo, distro, arch)
+
+	if len(debs) == 0 {
+		return "", nil
+	}
+
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+
+	for _, deb := range debs {
+		if err := LinkFile(deb, path.Join(dir, path.Base(deb))); err != nil {
+			return "", fmt.Errorf("Failed to add `%s' to the local repository: %s", path.Base(deb), err)
+		}
+	}
+
+	cmd := MakeCommandIn(dir, "dpkg-scanpackages", ".", "/dev/null")
+	cmd.Stdout = nil
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create the local repository: %s", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "Packages"), out, 0644); err != nil {
+		return "", err
+	}
+
+	if err := checkPbuilderSupport("local repositories", "AUTOBUILD_LOCAL_REPO", "D05autobuild-local"); err != nil {
+		return "", err
+	}
+
+	if options.Verbose {
+		fmt.Printf("Using local repository with %v packages in `%s'\n", len(debs), dir)
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type CommandLog struct {
+	Follow bool `short:"f" long:"follow" description:"Keep showing the output of the build while it is running"`
+}
+
+func (x *CommandLog) Execute(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Please specify the id of the build (see `autobuild queue')")
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+
+	if err != nil {
+		return fmt.Errorf("Invalid build id `%s'", args[0])
+	}
+
+	c, err := RemoteClient()
+
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	a := &Log{
+		Id: id,
+	}
+
+	if x.Follow {
+		a.Wait = 10
+	}
+
+	for {
+		ret := &LogReply{}
+
+		if err := c.Call("DaemonCommands.Log", a, ret); err != nil {
+			return err
+		}
+
+		os.Stdout.Write(ret.Data)
+		a.Offset = ret.Offset
+
+		if ret.Finished || !x.Follow {
+			break
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	parser.AddCommand("log",
+		"Show the output of a build",
+		"The log command shows the output of a build step, specified by its id. The ids of running build steps are shown by `autobuild queue'. When following the output (-f, --follow), the log command keeps showing new output of the build step until it has finished.",
+		&CommandLog{})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type LogOptions struct {
+	MaxAge   int `json:"max-age" description:"Remove build logs older than this many days (0 keeps logs forever)"`
+	MaxCount int `json:"max-count" description:"Keep the build logs of at most this many packages (0 for no limit)"`
+	MaxSize  int `json:"max-size" description:"Keep at most this many megabytes of build logs (0 for no limit)"`
+}
+
+type storedLogDir struct {
+	Id      uint64
+	Dir     string
+	Size    int64
+	ModTime time.Time
+}
+
+type storedLogDirs []*storedLogDir
+
+func (p storedLogDirs) Len() int {
+	return len(p)
+}
+
+func (p storedLogDirs) Less(i int, j int) bool {
+	return p[i].Id < p[j].Id
+}
+
+func (p storedLogDirs) Swap(i int, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func logStoreDir() string {
+	return path.Join(options.Base, "logs")
+}
+
+func logFileName(pkgid uint64, info *DistroBuildInfo) string {
+	d := info.Distribution
+
+	name := fmt.Sprintf("%v_%s_%s_%s.log.gz",
+		info.Id,
+		d.Os,
+		d.CodeName,
+		d.Architectures[0])
+
+	return path.Join(logStoreDir(), fmt.Sprintf("%v", pkgid), name)
+}
+
+func findLogFile(id uint64) string {
+	matches, _ := filepath.Glob(path.Join(logStoreDir(), "*", fmt.Sprintf("%v_*.log.gz", id)))
+
+	if len(matches) == 0 {
+		return ""
+	}
+
+	return matches[0]
+}
+
+func writeLogFile(filename string, data []byte) error {
+	os.MkdirAll(path.Dir(filename), 0755)
+
+	f, err := os.Create(filename)
+
+	if err != nil {
+		return err
+	}
+
+	wr := gzip.NewWriter(f)
+
+	if _, err := wr.Write(data); err != nil {
+		wr.Close()
+		f.Close()
+
+		return err
+	}
+
+	if err := wr.Close(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func readLogFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rd, err := gzip.NewReader(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+func (x *PackageBuilder) storeLog(binfo *BuildInfo, info *DistroBuildInfo) {
+	filename := logFileName(binfo.Info.Id, info)
+	data := []byte(info.output.String())
+
+	if err := writeLogFile(filename, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to store build log `%s': %s\n", filename, err)
+
+		// Keep the log in memory instead
+		info.Log = string(data)
+		return
+	}
+
+	info.LogFile = filename
+}
+
+func (x *DistroBuildInfo) readStoredLog() ([]byte, error) {
+	if len(x.LogFile) == 0 {
+		return []byte(x.Log), nil
+	}
+
+	return readLogFile(x.LogFile)
+}
+
+func (x *PackageBuilder) activePackageIds() map[uint64]bool {
+	ret := make(map[uint64]bool)
+
+	for id, _ := range x.CurrentlyBuilding {
+		ret[id] = true
+	}
+
+	for _, binfo := range x.FinishedPackages {
+		ret[binfo.Info.Id] = true
+	}
+
+	// Queued packages include retried packages, which keep the logs of
+	// their finished steps
+	for _, info := range x.PackageQueue {
+		ret[info.Id] = true
+	}
+
+	for id, _ := range x.resumable {
+		ret[id] = true
+	}
+
+	return ret
+}
+
+func (x *PackageBuilder) storedLogDirs() storedLogDirs {
+	f, err := os.Open(logStoreDir())
+
+	if err != nil {
+		return nil
+	}
+
+	names, _ := f.Readdirnames(0)
+	f.Close()
+
+	ret := make(storedLogDirs, 0, len(names))
+
+	for _, name := range names {
+		id, err := strconv.ParseUint(name, 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		dir := &storedLogDir{
+			Id:  id,
+			Dir: path.Join(logStoreDir(), name),
+		}
+
+		filepath.Walk(dir.Dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				dir.Size += info.Size()
+
+				if info.ModTime().After(dir.ModTime) {
+					dir.ModTime = info.ModTime()
+				}
+			}
+
+			return nil
+		})
+
+		ret = append(ret, dir)
+	}
+
+	sort.Sort(ret)
+	return ret
+}
+
+func (x *PackageBuilder) enforceLogRetention() {
+	opts := options.Logs
+
+	if opts.MaxAge <= 0 && opts.MaxCount <= 0 && opts.MaxSize <= 0 {
+		return
+	}
+
+	var active map[uint64]bool
+
+	x.Do(func(b *PackageBuilder) error {
+		active = b.activePackageIds()
+		return nil
+	})
+
+	dirs := x.storedLogDirs()
+
+	var total int64
+
+	for _, dir := range dirs {
+		total += dir.Size
+	}
+
+	count := len(dirs)
+	maxsize := int64(opts.MaxSize) * 1024 * 1024
+	oldest := time.Now().Add(-time.Duration(opts.MaxAge) * 24 * time.Hour)
+
+	// Remove the oldest logs first, but never logs of packages which are
+	// still building or waiting to be released
+	for _, dir := range dirs {
+		tooold := opts.MaxAge > 0 && dir.ModTime.Before(oldest)
+		toomany := opts.MaxCount > 0 && count > opts.MaxCount
+		toobig := opts.MaxSize > 0 && total > maxsize
+
+		if !tooold && !toomany && !toobig {
+			continue
+		}
+
+		if active[dir.Id] {
+			continue
+		}
+
+		if options.Verbose {
+			fmt.Printf("Removing build logs `%s'\n", dir.Dir)
+		}
+
+		os.RemoveAll(dir.Dir)
+
+		count--
+		total -= dir.Size
+	}
+}
+
+func (x *PackageBuilder) RunLogRetention() {
+	for {
+		x.enforceLogRetention()
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1 @@
+../buildcache.go
\ No newline at end of file
@@ -0,0 +1 @@
+../buildlog.go
\ No newline at end of file
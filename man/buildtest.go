@@ -0,0 +1 @@
+../buildtest.go
\ No newline at end of file
@@ -0,0 +1 @@
+../chroot.go
\ No newline at end of file
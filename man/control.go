@@ -0,0 +1 @@
+../control.go
\ No newline at end of file
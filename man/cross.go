@@ -0,0 +1 @@
+../cross.go
\ No newline at end of file
@@ -0,0 +1 @@
+../dsc.go
\ No newline at end of file
@@ -0,0 +1 @@
+../environment.go
\ No newline at end of file
@@ -0,0 +1 @@
+../history.go
\ No newline at end of file
@@ -0,0 +1 @@
+../historystore.go
\ No newline at end of file
@@ -0,0 +1 @@
+../hooks.go
\ No newline at end of file
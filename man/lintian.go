@@ -0,0 +1 @@
+../lintian.go
\ No newline at end of file
@@ -0,0 +1 @@
+../localrepo.go
\ No newline at end of file
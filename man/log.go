@@ -0,0 +1 @@
+../log.go
\ No newline at end of file
@@ -0,0 +1 @@
+../logstore.go
\ No newline at end of file
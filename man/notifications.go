@@ -0,0 +1 @@
+../notifications.go
\ No newline at end of file
@@ -0,0 +1 @@
+../policy.go
\ No newline at end of file
@@ -0,0 +1 @@
+../queue.go
\ No newline at end of file
@@ -0,0 +1 @@
+../releasepolicy.go
\ No newline at end of file
@@ -0,0 +1 @@
+../reproducible.go
\ No newline at end of file
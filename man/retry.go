@@ -0,0 +1 @@
+../retry.go
\ No newline at end of file
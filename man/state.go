@@ -0,0 +1 @@
+../state.go
\ No newline at end of file
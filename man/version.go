@@ -0,0 +1 @@
+../version.go
\ No newline at end of file
@@ -0,0 +1 @@
+../workers.go
\ No newline at end of file
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NotifyFinished  = "finished"
+	NotifyReleased  = "released"
+	NotifyDiscarded = "discarded"
+)
+
+type SmtpOptions struct {
+	Host     string `json:"host,omitempty" description:"The SMTP server (host:port) used to send notification emails"`
+	Username string `json:"username,omitempty" description:"The SMTP user name, if the server requires authentication"`
+	Password string `json:"password,omitempty" description:"The SMTP password"`
+	From     string `json:"from,omitempty" description:"The sender address of notification emails"`
+	Domain   string `json:"domain,omitempty" description:"The email domain of users (user@domain) without a configured address"`
+
+	// Email addresses of users (by user name)
+	Addresses map[string]string `json:"addresses,omitempty"`
+}
+
+type NotificationOptions struct {
+	// URLs to which notifications are posted as JSON
+	Webhooks []string `json:"webhooks,omitempty"`
+
+	// The events to notify (finished, released or discarded), all events
+	// when empty
+	Events []string `json:"events,omitempty"`
+
+	LogURL  string      `json:"log-url,omitempty" description:"The URL of build logs in notifications, where ${id} is replaced by the build id"`
+	Retries int         `json:"retries" description:"The number of times a notification is delivered before giving up"`
+	Smtp    SmtpOptions `json:"smtp"`
+}
+
+type NotificationBuild struct {
+	*HistoryRecord
+
+	LogURL string `json:",omitempty"`
+}
+
+type Notification struct {
+	Event     string
+	Time      time.Time
+	PackageId uint64
+	Package   string
+	Version   string
+	Uid       uint32
+	Owner     string
+	Error     string `json:",omitempty"`
+	Builds    []*NotificationBuild
+}
+
+// NotificationRecord records an attempt to deliver a notification.
+type NotificationRecord struct {
+	Time      time.Time
+	Event     string
+	PackageId uint64
+	Package   string
+	Version   string
+	Owner     string
+	Target    string
+	Attempt   int
+	Delivered bool
+	Error     string `json:",omitempty"`
+}
+
+type NotificationStore struct {
+	mutex sync.Mutex
+}
+
+var notifications NotificationStore
+
+func (x *NotificationOptions) enabled(event string) bool {
+	if len(x.Webhooks) == 0 && len(x.Smtp.Host) == 0 {
+		return false
+	}
+
+	if len(x.Events) == 0 {
+		return true
+	}
+
+	for _, e := range x.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (x *NotificationOptions) logURL(id uint64) string {
+	if len(x.LogURL) == 0 {
+		return ""
+	}
+
+	return os.Expand(x.LogURL, func(name string) string {
+		if name == "id" {
+			return fmt.Sprintf("%v", id)
+		}
+
+		return ""
+	})
+}
+
+// address returns the email address of the user with the given name.
+func (x *SmtpOptions) address(name string) string {
+	if addr, ok := x.Addresses[name]; ok {
+		return addr
+	}
+
+	if len(x.Domain) == 0 {
+		return ""
+	}
+
+	return name + "@" + x.Domain
+}
+
+func (x *NotificationStore) filename() string {
+	return path.Join(options.Base, "history", "notifications.json")
+}
+
+func (x *NotificationStore) Append(r *NotificationRecord) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	filename := x.filename()
+	os.MkdirAll(path.Dir(filename), 0755)
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(r)
+}
+
+// Query returns the delivery records of notifications of the given package
+// (or all packages if name is empty) for the user uid.
+func (x *NotificationStore) Query(name string, uid uint32) ([]*NotificationRecord, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	ret := make([]*NotificationRecord, 0)
+
+	owner := fmt.Sprintf("%v", uid)
+
+	if us, err := user.LookupId(owner); err == nil {
+		owner = us.Username
+	}
+
+	f, err := os.Open(x.filename())
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		r := &NotificationRecord{}
+
+		// Skip records which were not completely written
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue
+		}
+
+		if r.Owner == owner && (len(name) == 0 || r.Package == name) {
+			ret = append(ret, r)
+		}
+	}
+
+	return ret, scanner.Err()
+}
+
+func makeNotification(event string, binfo *BuildInfo, steps []*DistroBuildInfo) *Notification {
+	record := makeHistoryRecord(binfo, nil, event)
+
+	ret := &Notification{
+		Event:     event,
+		Time:      time.Now(),
+		PackageId: binfo.Info.Id,
+		Package:   binfo.Info.Name,
+		Version:   binfo.Info.Version,
+		Uid:       binfo.Info.Uid,
+		Owner:     record.Owner,
+		Error:     record.Error,
+		Builds:    make([]*NotificationBuild, 0, len(steps)),
+	}
+
+	for _, info := range steps {
+		status := event
+
+		if event == NotifyFinished {
+			status = buildStatus(info.Error, info.TimedOut)
+		}
+
+		ret.Builds = append(ret.Builds, &NotificationBuild{
+			HistoryRecord: makeHistoryRecord(binfo, info, status),
+			LogURL:        options.Notifications.logURL(info.Id),
+		})
+	}
+
+	return ret
+}
+
+func (x *Notification) Subject() string {
+	status := x.Event
+
+	if x.Event == NotifyFinished {
+		status = "built"
+
+		for _, b := range x.Builds {
+			if b.Status != HistoryBuilt {
+				status = "failed"
+			}
+		}
+
+		if len(x.Error) != 0 {
+			status = "failed"
+		}
+	}
+
+	return fmt.Sprintf("[autobuild] %s %s %s", x.Package, x.Version, status)
+}
+
+func (x *Notification) Text() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Package: %s %s\n", x.Package, x.Version)
+	fmt.Fprintf(&buf, "Event:   %s\n", x.Event)
+
+	if len(x.Error) != 0 {
+		fmt.Fprintf(&buf, "Error:   %s\n", x.Error)
+	}
+
+	fmt.Fprintln(&buf)
+
+	for _, b := range x.Builds {
+		fmt.Fprintf(&buf, "  %s: %s", b.Distribution, b.Status)
+
+		if len(b.Error) != 0 && x.Event == NotifyFinished {
+			fmt.Fprintf(&buf, " (%s)", b.Error)
+		}
+
+		fmt.Fprintln(&buf)
+
+		if len(b.LogURL) != 0 {
+			fmt.Fprintf(&buf, "    %s\n", b.LogURL)
+		}
+	}
+
+	return buf.String()
+}
+
+func (x *Notification) postWebhook(url string) error {
+	data, err := json.Marshal(x)
+
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("The webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (x *Notification) sendEmail(to string) error {
+	opts := &options.Notifications.Smtp
+
+	from := opts.From
+
+	if len(from) == 0 {
+		from = "autobuild"
+	}
+
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", x.Subject())
+	fmt.Fprintf(&msg, "Date: %s\r\n", x.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(x.Text(), "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+
+	if len(opts.Username) != 0 {
+		host, _, err := net.SplitHostPort(opts.Host)
+
+		if err != nil {
+			host = opts.Host
+		}
+
+		auth = smtp.PlainAuth("", opts.Username, opts.Password, host)
+	}
+
+	return smtp.SendMail(opts.Host, auth, from, []string{to}, msg.Bytes())
+}
+
+// deliver delivers a notification to a target, retrying with an increasing
+// delay. Every attempt is recorded.
+func (x *Notification) deliver(target string, send func() error) {
+	retries := options.Notifications.Retries
+
+	if retries <= 0 {
+		retries = 1
+	}
+
+	delay := time.Minute
+
+	for attempt := 1; attempt <= retries; attempt++ {
+		err := send()
+
+		r := &NotificationRecord{
+			Time:      time.Now(),
+			Event:     x.Event,
+			PackageId: x.PackageId,
+			Package:   x.Package,
+			Version:   x.Version,
+			Owner:     x.Owner,
+			Target:    target,
+			Attempt:   attempt,
+			Delivered: err == nil,
+		}
+
+		if err != nil {
+			r.Error = err.Error()
+			fmt.Fprintf(os.Stderr, "Failed to deliver notification to `%s' (attempt %v): %s\n", target, attempt, err)
+		}
+
+		if e := notifications.Append(r); e != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record notification: %s\n", e)
+		}
+
+		if err == nil {
+			return
+		}
+
+		if attempt < retries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// notifyUsers sends notifications of an event of a package to the
+// configured webhooks and to the owner of the package by email. The
+// notifications are delivered in the background.
+func (x *PackageBuilder) notifyUsers(event string, binfo *BuildInfo, steps []*DistroBuildInfo) {
+	opts := &options.Notifications
+
+	if !opts.enabled(event) {
+		return
+	}
+
+	n := makeNotification(event, binfo, steps)
+
+	for _, url := range opts.Webhooks {
+		url := url
+		go n.deliver(url, func() error { return n.postWebhook(url) })
+	}
+
+	if len(opts.Smtp.Host) != 0 {
+		if to := opts.Smtp.address(n.Owner); len(to) != 0 {
+			go n.deliver(to, func() error { return n.sendEmail(to) })
+		}
+	}
+}
+
+// notifyDisposition notifies the release or discard of builds, grouped per
+// package.
+func (x *PackageBuilder) notifyDisposition(event string, steps map[*DistroBuildInfo]*BuildInfo) {
+	packages := make(map[*BuildInfo][]*DistroBuildInfo)
+
+	for info, binfo := range steps {
+		packages[binfo] = append(packages[binfo], info)
+	}
+
+	for binfo, infos := range packages {
+		x.notifyUsers(event, binfo, infos)
+	}
+}
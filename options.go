@@ -6,6 +6,7 @@ import (
 	"github.com/jessevdk/go-flags"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 )
 
@@ -14,6 +15,41 @@ import "C"
 
 type BuildOptions struct {
 	Distributions []*Distribution `json:"distributions,omit-empty"`
+	Timeouts      BuildTimeouts   `json:"timeouts,omitempty"`
+
+	// Stop building a package when any of its builds fails, instead of
+	// building the remaining distributions and architectures
+	FailFast bool `json:"fail-fast,omitempty"`
+
+	// Make the binary packages of finished, not yet released build
+	// dependencies available to the build through a local repository
+	LocalDependencies bool `json:"local-dependencies,omitempty"`
+
+	Lintian      LintianOptions      `json:"lintian,omitempty"`
+	Tests        TestOptions         `json:"tests,omitempty"`
+	Reproducible ReproducibleOptions `json:"reproducible,omitempty"`
+
+	// Build environment settings (DEB_BUILD_OPTIONS, extra packages, etc.)
+	Environment BuildEnvironment `json:"environment,omitempty"`
+}
+
+// copy returns a deep copy of the build options (including the
+// distributions and all lists), so that decoding the options of a package
+// does not modify the configured options.
+func (x *BuildOptions) copy() BuildOptions {
+	var ret BuildOptions
+
+	if data, err := json.Marshal(x); err == nil {
+		json.Unmarshal(data, &ret)
+	}
+
+	return ret
+}
+
+type BuilderOptions struct {
+	MaxBuilds int            `json:"max-builds" description:"The maximum number of builds running at the same time"`
+	Limits    map[string]int `json:"limits,omitempty" description:"The maximum number of builds running at the same time for a distribution (e.g. ubuntu/precise) or distribution architecture (e.g. ubuntu/precise/amd64)"`
+	Timeouts  BuildTimeouts  `json:"timeouts"`
 }
 
 type RepositoryOptions struct {
@@ -35,11 +71,20 @@ type Options struct {
 	BuildOptions BuildOptions           `json:"build-options,omit-empty" config:"-"`
 	Pbuilder     string                 `json:"pbuilder"`
 	UseTmpfs     bool                   `json:"use-tmpfs"`
+	Builder      BuilderOptions         `json:"builder"`
+	Logs         LogOptions             `json:"logs"`
 	Repository   RepositoryOptions      `json:"repository"`
 	GroupFlag    func(val string) error `short:"g" long:"group" description:"Authenticated group for autobuild communication" default:"autobuild" json:"-"`
 
 	Group   string `json:"group,omitempty"`
 	GroupId uint32 `json:"-"`
+
+	ReleasePolicies []*ReleasePolicy `json:"release-policies,omitempty"`
+
+	// Hook commands per phase (e.g. pre-source), see hooks.go
+	Hooks map[string][]string `json:"hooks,omitempty"`
+
+	Notifications NotificationOptions `json:"notifications"`
 }
 
 func (x *Options) LoadConfig() {
@@ -72,6 +117,82 @@ func (x *BuildOptions) HasDistribution(distro *Distribution, arch string) bool {
 	return false
 }
 
+func (x *BuildOptions) FindDistribution(distro *Distribution) *Distribution {
+	for _, distrocfg := range x.Distributions {
+		if distrocfg.Os == distro.Os && distrocfg.CodeName == distro.CodeName {
+			return distrocfg
+		}
+	}
+
+	return nil
+}
+
+// SelectDistributions returns the configured distributions matching the
+// given names. Names are either os/codename, selecting all configured
+// architectures, or os/codename/arch.
+func (x *BuildOptions) SelectDistributions(names []string) ([]*Distribution, error) {
+	ret := make([]*Distribution, 0, len(names))
+	selected := make(map[string]*Distribution)
+
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("Invalid distribution `%s' (expected os/codename or os/codename/arch)", name)
+		}
+
+		distro := &Distribution{
+			Os:       parts[0],
+			CodeName: parts[1],
+		}
+
+		distrocfg := x.FindDistribution(distro)
+
+		if distrocfg == nil {
+			return nil, fmt.Errorf("The distribution `%s' is not configured", distro.SourceName())
+		}
+
+		archs := distrocfg.Architectures
+
+		if len(parts) == 3 {
+			if !x.HasDistribution(distro, parts[2]) {
+				return nil, fmt.Errorf("The architecture `%s' is not configured for `%s'", parts[2], distro.SourceName())
+			}
+
+			archs = []string{parts[2]}
+		}
+
+		sel := selected[distro.SourceName()]
+
+		if sel == nil {
+			cp := *distrocfg
+			cp.Architectures = nil
+
+			sel = &cp
+			selected[distro.SourceName()] = sel
+
+			ret = append(ret, sel)
+		}
+
+		for _, arch := range archs {
+			found := false
+
+			for _, a := range sel.Architectures {
+				if a == arch {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				sel.Architectures = append(sel.Architectures, arch)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
 func (x *Options) UpdateConfig(updateFunc func(*Options) error) error {
 	dirname := path.Join(options.Base, "etc")
 	filename := path.Join(dirname, "autobuild.json")
@@ -137,11 +258,27 @@ var options = &Options{
 
 	Pbuilder: "cowbuilder",
 
+	BuildOptions: BuildOptions{
+		Lintian: LintianOptions{
+			MaxErrors:   0,
+			MaxWarnings: -1,
+			MaxInfo:     -1,
+		},
+	},
+
 	Repository: RepositoryOptions{
 		ListenPort: "8080",
 	},
 
 	UseTmpfs: false,
+
+	Builder: BuilderOptions{
+		MaxBuilds: 1,
+	},
+
+	Notifications: NotificationOptions{
+		Retries: 5,
+	},
 }
 
 var parser = flags.NewParser(options, flags.Default)
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBuildOptionsCopy(t *testing.T) {
+	network := true
+
+	opts := BuildOptions{
+		Distributions: []*Distribution{
+			{Os: "ubuntu", CodeName: "jammy", Architectures: []string{"amd64"}, Timeouts: &BuildTimeouts{Binary: 60}},
+		},
+		Lintian:      LintianOptions{Enabled: true, MaxErrors: 0, MaxWarnings: -1, MaxInfo: -1},
+		Reproducible: ReproducibleOptions{Enabled: true, Distributions: []string{"ubuntu/*"}},
+		Environment: BuildEnvironment{
+			DebBuildOptions: []string{"nocheck"},
+			Env:             map[string]string{"FOO": "bar"},
+			Network:         &network,
+		},
+	}
+
+	pkg := `{
+		"distributions": [{"os": "debian", "codename": "bookworm", "architectures": ["arm64"], "timeouts": {"binary": 10}}],
+		"reproducible": {"enabled": false, "distributions": ["debian/*"]},
+		"environment": {"deb-build-options": ["nodoc"], "env": {"FOO": "baz"}, "network": false}
+	}`
+
+	bopts := opts.copy()
+
+	if err := json.NewDecoder(strings.NewReader(pkg)).Decode(&bopts); err != nil {
+		t.Fatal(err)
+	}
+
+	d := opts.Distributions[0]
+
+	if d.Os != "ubuntu" || d.CodeName != "jammy" || d.Architectures[0] != "amd64" || d.Timeouts.Binary != 60 {
+		t.Errorf("The configured distribution was modified: %+v", d)
+	}
+
+	if !opts.Reproducible.Enabled || opts.Reproducible.Distributions[0] != "ubuntu/*" {
+		t.Errorf("The configured reproducible options were modified: %+v", opts.Reproducible)
+	}
+
+	env := opts.Environment
+
+	if env.DebBuildOptions[0] != "nocheck" || env.Env["FOO"] != "bar" || !*env.Network {
+		t.Errorf("The configured environment was modified: %s", &env)
+	}
+
+	if bopts.Distributions[0].CodeName != "bookworm" || bopts.Environment.Env["FOO"] != "baz" || *bopts.Environment.Network {
+		t.Errorf("The package options were not decoded: %+v", bopts)
+	}
+
+	if !bopts.Lintian.Enabled || bopts.Lintian.MaxWarnings != -1 {
+		t.Errorf("The configured lintian options were not copied: %+v", bopts.Lintian)
+	}
+}
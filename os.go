@@ -15,6 +15,27 @@ func MoveFile(source string, dest string) error {
 	}
 
 	// Try copy instead
+	if err := CopyFile(source, dest); err != nil {
+		return err
+	}
+
+	// Remove source after copy
+	return os.Remove(source)
+}
+
+// LinkFile hard links source to dest, or copies it when it cannot be
+// linked (e.g. across file systems).
+func LinkFile(source string, dest string) error {
+	os.MkdirAll(path.Dir(dest), 0755)
+
+	if err := os.Link(source, dest); err == nil {
+		return nil
+	}
+
+	return CopyFile(source, dest)
+}
+
+func CopyFile(source string, dest string) error {
 	fr, err := os.Open(source)
 
 	if err != nil {
@@ -31,14 +52,52 @@ func MoveFile(source string, dest string) error {
 
 	_, err = io.Copy(fw, fr)
 
-	fw.Close()
+	if e := fw.Close(); err == nil {
+		err = e
+	}
 
-	// Remove source after copy
-	fr.Close()
+	return err
+}
+
+// WriteFileAtomic writes a file by writing to a temporary file first, and
+// renaming it over the target when the contents have been written (and
+// synced) successfully. Readers thus see either the old or the new
+// contents, never a partially written file.
+func WriteFileAtomic(filename string, fn func(writer io.Writer) error) error {
+	dirname := path.Dir(filename)
+	os.MkdirAll(dirname, 0755)
+
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
 
 	if err != nil {
 		return err
 	}
 
-	return os.Remove(source)
+	err = fn(f)
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Make sure the rename itself is on disk
+	if d, err := os.Open(dirname); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
 }
@@ -1,30 +1,79 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"strings"
 )
 
 type PackageInfo struct {
+	Id          uint64
 	StageFile   string
 	Name        string
 	Version     string
 	Compression string
 	Uid         uint32
+	Priority    int
+
+	// Distributions selected when staging, overriding the distributions
+	// in the build options
+	Distributions []*Distribution
+
+	// Build without reusing the results of previous builds with the same
+	// inputs (see the build cache)
+	Force bool
+
+	// The files referenced by a staged source package (.dsc), and its
+	// full version
+	Files         []string
+	SourceVersion string
+
+	// The binary packages built from the package and the packages it
+	// build-depends on, used to build queued dependencies first
+	Binaries     []string
+	BuildDepends []string
 }
 
 func NewPackageInfo(filename string, uid uint32) *PackageInfo {
 	basename := path.Base(filename)
+
+	if strings.HasSuffix(basename, ".dsc") {
+		dsc, err := ParseDscFile(filename)
+
+		if err != nil {
+			return nil
+		}
+
+		return &PackageInfo{
+			StageFile:     filename,
+			Name:          dsc.Source,
+			Version:       dsc.UpstreamVersion(),
+			SourceVersion: dsc.Version,
+			Uid:           uid,
+			Files:         dsc.Files(),
+			Binaries:      dsc.Binaries(),
+			BuildDepends:  dsc.BuildDepends(),
+		}
+	}
+
 	matched := packageInfoRegex.FindStringSubmatch(basename)
 
 	if matched == nil {
 		return nil
 	}
 
+	if _, err := ParseDebianVersion(matched[2]); err != nil {
+		return nil
+	}
+
 	return &PackageInfo{
 		StageFile:   filename,
 		Name:        matched[1],
 		Version:     matched[2],
-		Compression: matched[4],
+		Compression: matched[3],
 		Uid:         uid,
 	}
 }
@@ -36,3 +85,147 @@ func (x *PackageInfo) MatchStageFile(filename string) bool {
 
 	return path.Base(x.StageFile) == filename
 }
+
+// DebianVersion returns the version of the package. For packages with the
+// autobuild layout, this is only the upstream version since the revision
+// is not known before the package is extracted.
+func (x *PackageInfo) DebianVersion() (*DebianVersion, error) {
+	if len(x.SourceVersion) != 0 {
+		return ParseDebianVersion(x.SourceVersion)
+	}
+
+	return ParseDebianVersion(x.Version)
+}
+
+func (x *PackageInfo) IsDsc() bool {
+	return strings.HasSuffix(x.StageFile, ".dsc")
+}
+
+// StageFilesDir returns the directory containing the files referenced by
+// a staged source package.
+func (x *PackageInfo) StageFilesDir() string {
+	return x.StageFile + ".files"
+}
+
+func (x *PackageInfo) RemoveStageFiles() {
+	os.Remove(x.StageFile)
+
+	if x.IsDsc() {
+		os.RemoveAll(x.StageFilesDir())
+	}
+}
+
+// TarFlags returns the tar flags to extract a staged package with the
+// autobuild layout.
+func (x *PackageInfo) TarFlags() string {
+	switch x.Compression {
+	case "xz":
+		return "-xJ"
+	case "bz2":
+		return "-xj"
+	}
+
+	return "-xz"
+}
+
+// ReadDependencies reads the binary packages and build dependencies of a
+// staged package with the autobuild layout from debian/control in its
+// debian diff. Source packages (.dsc) list them in the .dsc itself.
+func (x *PackageInfo) ReadDependencies() error {
+	if x.IsDsc() {
+		return nil
+	}
+
+	diffgz := fmt.Sprintf("%s_%s.diff.gz", x.Name, x.Version)
+	out, err := RunOutputCommand("tar", x.TarFlags()+"Of", x.StageFile, diffgz)
+
+	if err != nil {
+		return err
+	}
+
+	control, err := fileFromDiff(out, "debian/control")
+
+	if err != nil {
+		return err
+	}
+
+	paragraphs, err := ParseControl(bytes.NewReader(control))
+
+	if err != nil {
+		return fmt.Errorf("Failed to parse debian/control: %s", err)
+	}
+
+	x.Binaries = nil
+	x.BuildDepends = nil
+
+	for _, p := range paragraphs {
+		if name, ok := p["Package"]; ok {
+			x.Binaries = append(x.Binaries, name)
+		} else if _, ok := p["Source"]; ok {
+			x.BuildDepends = ParseDependencyNames(p["Build-Depends"] + "," + p["Build-Depends-Indep"] + "," + p["Build-Depends-Arch"])
+		}
+	}
+
+	return nil
+}
+
+// ReadChangelogHeader reads the top entry of debian/changelog of a staged
+// package, from its debian diff or debian tarball.
+func (x *PackageInfo) ReadChangelogHeader() (*ChangelogHeader, error) {
+	var out []byte
+	var err error
+
+	if !x.IsDsc() {
+		diffgz := fmt.Sprintf("%s_%s.diff.gz", x.Name, x.Version)
+		out, err = RunOutputCommand("tar", x.TarFlags()+"Of", x.StageFile, diffgz)
+
+		if err == nil {
+			out, err = fileFromDiff(out, "debian/changelog")
+		}
+	} else {
+		err = fmt.Errorf("The source package does not reference a debian diff or tarball")
+
+		for _, name := range x.Files {
+			filename := path.Join(x.StageFilesDir(), name)
+
+			if strings.HasSuffix(name, ".diff.gz") {
+				if out, err = ioutil.ReadFile(filename); err == nil {
+					out, err = fileFromDiff(out, "debian/changelog")
+				}
+
+				break
+			} else if strings.Contains(name, ".debian.tar.") {
+				out, err = RunOutputCommand("tar", "-xOf", filename, "debian/changelog")
+				break
+			} else if strings.Contains(name, ".tar.") && !strings.Contains(name, ".orig") {
+				// Native source packages contain the debian
+				// directory in their only tarball
+				out, err = RunOutputCommand("tar", "--wildcards", "-xOf", filename, "*/debian/changelog")
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadChangelogHeader(bytes.NewReader(out))
+}
+
+// DependsOn returns whether the package build-depends on one of the binary
+// packages built from other.
+func (x *PackageInfo) DependsOn(other *PackageInfo) bool {
+	if x.Id == other.Id {
+		return false
+	}
+
+	for _, dep := range x.BuildDepends {
+		for _, name := range other.Binaries {
+			if dep == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
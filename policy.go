@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+)
+
+type SchedulePolicy string
+
+const (
+	// Build packages in the order in which they were queued
+	SchedulePolicyFifo SchedulePolicy = "fifo"
+
+	// Build packages by priority, and round-robin between the owners of
+	// packages with the same priority
+	SchedulePolicyFair SchedulePolicy = "fair"
+)
+
+func (x SchedulePolicy) IsValid() bool {
+	return x == SchedulePolicyFifo || x == SchedulePolicyFair
+}
+
+func (x *PackageBuilder) preferQueued(info *PackageInfo, other *PackageInfo, served map[uint32]uint64) bool {
+	if x.Policy != SchedulePolicyFair {
+		return false
+	}
+
+	if info.Priority != other.Priority {
+		return info.Priority > other.Priority
+	}
+
+	// Prefer the owner which was least recently served
+	return served[info.Uid] < served[other.Uid]
+}
+
+// queuedDependency returns the index of the package in queue which should
+// be built before the package at index i, following build dependencies on
+// other queued packages. Dependency cycles are broken at the first package
+// seen twice.
+func queuedDependency(queue []*PackageInfo, i int) int {
+	visited := make(map[int]bool)
+
+	for !visited[i] {
+		visited[i] = true
+		next := -1
+
+		for j, dep := range queue {
+			if !visited[j] && queue[i].DependsOn(dep) {
+				next = j
+				break
+			}
+		}
+
+		if next == -1 {
+			break
+		}
+
+		i = next
+	}
+
+	return i
+}
+
+// waitsForBuilding returns whether the package build-depends on a package
+// which is currently building.
+func (x *PackageBuilder) waitsForBuilding(info *PackageInfo) bool {
+	for _, building := range x.CurrentlyBuilding {
+		if info.DependsOn(building) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextQueued returns the index of the package in queue to build next, or
+// -1 if all queued packages wait for a dependency which is currently
+// building.
+func (x *PackageBuilder) nextQueued(queue []*PackageInfo, served map[uint32]uint64) int {
+	waiting := make(map[int]bool)
+
+	for {
+		best := -1
+
+		for i, info := range queue {
+			if waiting[i] {
+				continue
+			}
+
+			if best == -1 || x.preferQueued(info, queue[best], served) {
+				best = i
+			}
+		}
+
+		if best == -1 {
+			return -1
+		}
+
+		// Build the dependencies of the package first
+		i := queuedDependency(queue, best)
+
+		if !x.waitsForBuilding(queue[i]) {
+			return i
+		}
+
+		waiting[best] = true
+		waiting[i] = true
+	}
+}
+
+func (x *PackageBuilder) scheduledQueue() []*PackageInfo {
+	queue := make([]*PackageInfo, len(x.PackageQueue))
+	copy(queue, x.PackageQueue)
+
+	served := make(map[uint32]uint64)
+
+	for k, v := range x.served {
+		served[k] = v
+	}
+
+	count := x.servedCount
+	ret := make([]*PackageInfo, 0, len(queue))
+
+	for len(queue) > 0 {
+		i := x.nextQueued(queue, served)
+
+		// Packages waiting for dependencies follow in queue order
+		if i == -1 {
+			ret = append(ret, queue...)
+			break
+		}
+
+		info := queue[i]
+
+		queue = append(queue[:i], queue[i+1:]...)
+		ret = append(ret, info)
+
+		count++
+		served[info.Uid] = count
+	}
+
+	return ret
+}
+
+func (x *PackageBuilder) SetPolicy(policy SchedulePolicy) error {
+	if !policy.IsValid() {
+		return fmt.Errorf("Unknown scheduling policy `%s' (use %s or %s)",
+			policy,
+			SchedulePolicyFifo,
+			SchedulePolicyFair)
+	}
+
+	return x.Do(func(b *PackageBuilder) error {
+		b.Policy = policy
+		b.journal(&journalEntry{Op: journalPolicy, Policy: policy})
+
+		return nil
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNextQueued(t *testing.T) {
+	a := &PackageInfo{Id: 1, Uid: 1000, Binaries: []string{"liba-dev"}}
+	b := &PackageInfo{Id: 2, Uid: 1000, Priority: 1}
+	c := &PackageInfo{Id: 3, Uid: 1001, BuildDepends: []string{"liba-dev"}}
+	d := &PackageInfo{Id: 4, Uid: 1001}
+	e := &PackageInfo{Id: 5, Uid: 1002, Priority: 1, BuildDepends: []string{"liba-dev"}}
+
+	tests := []struct {
+		name     string
+		policy   SchedulePolicy
+		queue    []*PackageInfo
+		building []*PackageInfo
+		served   map[uint32]uint64
+		expected int
+	}{
+		{"empty", SchedulePolicyFifo, nil, nil, nil, -1},
+		{"fifo order", SchedulePolicyFifo, []*PackageInfo{a, b, d}, nil, nil, 0},
+		{"fifo ignores priority", SchedulePolicyFifo, []*PackageInfo{d, b}, nil, nil, 0},
+		{"fair priority", SchedulePolicyFair, []*PackageInfo{d, b}, nil, nil, 1},
+		{"fair least recently served", SchedulePolicyFair, []*PackageInfo{a, d}, nil, map[uint32]uint64{1000: 2, 1001: 1}, 1},
+		{"fair never served", SchedulePolicyFair, []*PackageInfo{a, d}, nil, map[uint32]uint64{1000: 2}, 1},
+		{"dependency first", SchedulePolicyFifo, []*PackageInfo{c, a}, nil, nil, 1},
+		{"dependency of higher priority first", SchedulePolicyFair, []*PackageInfo{a, d, e}, nil, nil, 0},
+		{"skip waiting for building", SchedulePolicyFifo, []*PackageInfo{c, d}, []*PackageInfo{a}, nil, 1},
+		{"all waiting for building", SchedulePolicyFair, []*PackageInfo{c, e}, []*PackageInfo{a}, nil, -1},
+	}
+
+	for _, test := range tests {
+		x := &PackageBuilder{
+			Policy:            test.policy,
+			CurrentlyBuilding: make(PackageInfoMap),
+		}
+
+		for _, info := range test.building {
+			x.CurrentlyBuilding[info.Id] = info
+		}
+
+		served := test.served
+
+		if served == nil {
+			served = make(map[uint32]uint64)
+		}
+
+		if i := x.nextQueued(test.queue, served); i != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, i)
+		}
+	}
+}
+
+func TestFairQueueOffset(t *testing.T) {
+	a1 := &PackageInfo{Id: 1, Uid: 1000}
+	b1 := &PackageInfo{Id: 2, Uid: 1001}
+	a2 := &PackageInfo{Id: 3, Uid: 1000}
+	a3 := &PackageInfo{Id: 4, Uid: 1000, Priority: 1}
+	a4 := &PackageInfo{Id: 5, Uid: 1000}
+
+	tests := []struct {
+		id       uint64
+		offset   int
+		expected []uint64
+	}{
+		{3, -1, []uint64{3, 1, 2, 4, 5}},
+		{3, 1, []uint64{1, 2, 4, 5, 3}},
+		{1, 1, []uint64{2, 3, 1, 4, 5}},
+		{1, 10, []uint64{2, 3, 4, 5, 1}},
+		{5, -10, []uint64{5, 1, 2, 3, 4}},
+		{4, -1, []uint64{1, 2, 3, 4, 5}},
+		{2, 1, []uint64{1, 2, 3, 4, 5}},
+	}
+
+	for _, test := range tests {
+		x := &PackageBuilder{
+			PackageQueue: []*PackageInfo{a1, b1, a2, a3, a4},
+		}
+
+		i := x.findQueued(test.id)
+		x.moveQueued(i, x.fairQueueOffset(i, test.offset))
+
+		ids := make([]uint64, 0, len(x.PackageQueue))
+
+		for _, info := range x.PackageQueue {
+			ids = append(ids, info.Id)
+		}
+
+		if fmt.Sprint(ids) != fmt.Sprint(test.expected) {
+			t.Errorf("Moving %v by %v: expected %v, got %v", test.id, test.offset, test.expected, ids)
+		}
+	}
+}
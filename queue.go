@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type CommandQueue struct {
+	Remove bool `short:"d" long:"remove" description:"Remove the specified queued packages"`
+	Cancel bool `short:"c" long:"cancel" description:"Cancel the specified packages which are currently building"`
+	Up     bool `short:"u" long:"up" description:"Move the specified queued packages up in the queue"`
+	Down   bool `short:"n" long:"down" description:"Move the specified queued packages down in the queue"`
+
+	Policy string `short:"p" long:"policy" description:"Set the scheduling policy of the queue (fifo or fair)"`
+}
+
+func (x *CommandQueue) show() error {
+	a := &Queue{}
+	ret := &QueueReply{}
+
+	if err := RemoteCall("DaemonCommands.Queue", a, ret); err != nil {
+		return err
+	}
+
+	fmt.Printf("Scheduling policy: %s\n", ret.Policy)
+	fmt.Println()
+
+	if len(ret.Building) == 0 && len(ret.Queue) == 0 {
+		fmt.Println("There are no packages building or queued...")
+		return nil
+	}
+
+	sections := []struct {
+		Title    string
+		Packages []QueuedPackage
+	}{
+		{"Currently building", ret.Building},
+		{"Queued packages", ret.Queue},
+	}
+
+	for _, section := range sections {
+		if len(section.Packages) == 0 {
+			continue
+		}
+
+		fmt.Printf("%s:\n", section.Title)
+		fmt.Println()
+
+		for _, p := range section.Packages {
+			fmt.Printf("  %5d) %s %s (%s, priority %d)\n", p.Id, p.Name, p.Version, p.Owner, p.Priority)
+
+			for _, step := range p.Steps {
+				fmt.Printf("         %5d: %s\n", step.Id, step.Distribution.BinaryName(step.Distribution.Architectures[0]))
+			}
+		}
+
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func (x *CommandQueue) parseIds(args []string) ([]uint64, error) {
+	ids := make([]uint64, 0, len(args))
+
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid package id `%s'", arg)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (x *CommandQueue) Execute(args []string) error {
+	if len(x.Policy) != 0 {
+		pol := &QueuePolicy{
+			Policy: SchedulePolicy(x.Policy),
+		}
+
+		if err := RemoteCall("DaemonCommands.QueuePolicy", pol, &GeneralReply{}); err != nil {
+			return err
+		}
+	}
+
+	nactions := 0
+
+	for _, action := range []bool{x.Remove, x.Cancel, x.Up, x.Down} {
+		if action {
+			nactions++
+		}
+	}
+
+	if nactions == 0 {
+		return x.show()
+	}
+
+	if nactions > 1 {
+		return errors.New("Please specify only one of --remove, --cancel, --up or --down")
+	}
+
+	ids, err := x.parseIds(args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return errors.New("Please specify the ids of the packages (see `autobuild queue')")
+	}
+
+	if x.Remove {
+		return RemoteCall("DaemonCommands.QueueRemove", &QueueRemove{Packages: ids}, &QueueRemoveReply{})
+	}
+
+	if x.Cancel {
+		return RemoteCall("DaemonCommands.QueueCancel", &QueueCancel{Packages: ids}, &QueueCancelReply{})
+	}
+
+	offset := -1
+
+	if x.Down {
+		offset = 1
+	}
+
+	for _, id := range ids {
+		mv := &QueueMove{
+			Id:     id,
+			Offset: offset,
+		}
+
+		if err := RemoteCall("DaemonCommands.QueueMove", mv, &GeneralReply{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	parser.AddCommand("queue",
+		"List and manage queued and building packages",
+		"The queue command lists the packages which are currently building and the packages which are queued to be built, together with their id and owner. Queued packages can be removed (-d, --remove) or moved up (-u, --up) and down (-n, --down) in the queue by specifying their ids as arguments. With the `fair' scheduling policy, packages are moved among your queued packages of the same priority, since only these are built in the order of the queue. Packages which are currently building can be cancelled (-c, --cancel), in which case the build is recorded as cancelled. The output of the running build steps listed for a package can be followed with `autobuild log --follow <id>'. You can only manage packages that you have staged yourself. The scheduling policy (-p, --policy) determines which queued package is built next: `fifo' builds packages in the order in which they were queued, while `fair' builds packages with a higher priority first and alternates between the users that queued packages of the same priority. Only root or the user running the daemon can change the scheduling policy.",
+		&CommandQueue{})
+}
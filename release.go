@@ -43,6 +43,40 @@ func (x *CommandRelease) Execute(args []string) error {
 			r.Distribution.Architectures[0],
 			path.Base(r.Name))
 
+		if r.TimedOut {
+			fmt.Printf("  %sTIMEOUT: %s\n", strings.Repeat(" ", longest+4), r.Error)
+		} else if len(r.Error) != 0 {
+			fmt.Printf("  %sFAILED: %s\n", strings.Repeat(" ", longest+4), r.Error)
+		}
+
+		if r.Lintian != nil {
+			fmt.Printf("  %sLINTIAN: %s\n", strings.Repeat(" ", longest+4), r.Lintian)
+		}
+
+		if r.Environment != nil {
+			fmt.Printf("  %sENVIRONMENT: %s\n", strings.Repeat(" ", longest+4), r.Environment)
+		}
+
+		if len(r.Cached) != 0 {
+			fmt.Printf("  %sCACHED: %s\n", strings.Repeat(" ", longest+4), r.Cached)
+		}
+
+		if len(r.Published) != 0 {
+			fmt.Printf("  %sPUBLISHED: %s (not built again)\n", strings.Repeat(" ", longest+4), r.Published)
+		}
+
+		if r.Reproducible != nil {
+			fmt.Printf("  %sREPRODUCIBLE: %s\n", strings.Repeat(" ", longest+4), r.Reproducible)
+
+			for _, d := range r.Reproducible.Differences {
+				fmt.Printf("  %s  %s\n", strings.Repeat(" ", longest+4), d)
+			}
+		}
+
+		if r.Test != nil {
+			fmt.Printf("  %sTESTS: %s\n", strings.Repeat(" ", longest+4), r.Test)
+		}
+
 		for _, f := range r.Files {
 			fmt.Printf("  %s%s\n", strings.Repeat(" ", longest+4), path.Base(f))
 		}
@@ -116,6 +150,6 @@ func (x *CommandRelease) Execute(args []string) error {
 func init() {
 	parser.AddCommand("release",
 		"Release packages that have been built",
-		"The release command releases packages that have finished building. You will be presented with a list of finished packages and you can choose which packages to release. Note that you can specify packages by a comma separated list of their number (e.g. 1,2), ranges (e.g. 1:3) or use `*' to release all packages.",
+		"The release command releases packages that have finished building. You will be presented with a list of finished packages and you can choose which packages to release. Note that you can specify packages by a comma separated list of their number (e.g. 1,2), ranges (e.g. 1:3) or use `*' to release all packages. Successful builds can also be released automatically by release policies in the \"release-policies\" configuration, which select distributions (e.g. ubuntu/*) and users for which builds are released as soon as all builds for the distribution succeeded. When \"lintian\" is enabled in the build options, binary builds are checked with lintian and builds with more lintian tags of a severity than allowed (max-errors, max-warnings, max-info) cannot be released. The limits of the daemon configuration apply to all packages: the build options of a package can only enable lintian and lower the limits. When \"tests\" are enabled in the build options, binary builds are installed in a clean build environment and tested with autopkgtest if the package has debian/tests. Release policies with \"require-tests\" only allow releasing builds which passed their tests. When \"reproducible\" is enabled in the build options (optionally for the distributions matching its \"distributions\" patterns), binary packages are built a second time with a different build path, time zone, umask and clock, and the builds are shown as reproducible or unreproducible, with the files which differ between the builds.",
 		&CommandRelease{})
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+)
+
+// ReleasePolicy decides whether successful builds are released
+// automatically. Policies are evaluated in order when a build finishes and
+// the first policy matching the distribution and owner of the build applies.
+// Builds not matching any policy are released manually.
+type ReleasePolicy struct {
+	// Distribution patterns (e.g. ubuntu/* or debian/stable), matching all
+	// distributions when empty
+	Distributions []string `json:"distributions,omitempty"`
+
+	// User names or uids of the owners, matching all users when empty
+	Users []string `json:"users,omitempty"`
+
+	// Release successful builds automatically
+	AutoRelease bool `json:"auto-release"`
+
+	// Only allow releasing binary builds which passed their tests (see
+	// the tests build option)
+	RequireTests bool `json:"require-tests,omitempty"`
+}
+
+func (x *ReleasePolicy) matchesDistribution(distro *Distribution) bool {
+	if len(x.Distributions) == 0 {
+		return true
+	}
+
+	for _, pattern := range x.Distributions {
+		if ok, _ := path.Match(pattern, distro.SourceName()); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (x *ReleasePolicy) matchesUser(uid uint32) bool {
+	if len(x.Users) == 0 {
+		return true
+	}
+
+	id := fmt.Sprintf("%v", uid)
+	name := ""
+
+	if us, err := user.LookupId(id); err == nil {
+		name = us.Username
+	}
+
+	for _, u := range x.Users {
+		if u == id || (len(name) != 0 && u == name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReleasePolicy returns the release policy for builds for distro owned by
+// uid, or nil if no policy applies.
+func (x *Options) ReleasePolicy(distro *Distribution, uid uint32) *ReleasePolicy {
+	for _, policy := range x.ReleasePolicies {
+		if policy.matchesDistribution(distro) && policy.matchesUser(uid) {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+// AutoRelease returns whether builds for distro owned by uid are released
+// automatically.
+func (x *Options) AutoRelease(distro *Distribution, uid uint32) bool {
+	policy := x.ReleasePolicy(distro, uid)
+	return policy != nil && policy.AutoRelease
+}
+
+// releaseBlocked returns why a build owned by uid cannot be released, or
+// an empty string if it can be released.
+func (x *DistroBuildInfo) releaseBlocked(uid uint32) string {
+	if x.Lintian != nil && len(x.Lintian.Blocked) != 0 {
+		return x.Lintian.Blocked
+	}
+
+	if x.Distribution.IsSource() {
+		return ""
+	}
+
+	if policy := options.ReleasePolicy(&x.Distribution, uid); policy != nil && policy.RequireTests {
+		if x.Test == nil {
+			return "the build was not tested"
+		} else if !x.Test.Passed {
+			return "the tests did not pass"
+		}
+	}
+
+	return ""
+}
+
+// autoRelease releases the builds of a finished package for which the
+// release policies enable automatic releases. Builds of a distribution are
+// only released when all builds of the package for that distribution
+// succeeded and none of them is blocked from release. Cancelled packages
+// and distributions of which not all architectures were built are never
+// released automatically. The builds are released in the background.
+func (x *PackageBuilder) autoRelease(binfo *BuildInfo) {
+	if binfo.cancelled || binfo.Package == nil {
+		return
+	}
+
+	failed := make(map[string]bool)
+
+	for _, distro := range binfo.Package.Options.Distributions {
+		if !binfo.builtDistribution(distro) {
+			failed[distro.SourceName()] = true
+		}
+	}
+
+	for _, info := range binfo.Packages {
+		// Blocked builds are left to be released manually
+		if info.Error != nil || len(info.releaseBlocked(binfo.Info.Uid)) != 0 {
+			failed[info.Distribution.SourceName()] = true
+		}
+	}
+
+	ids := make([]uint64, 0, len(binfo.Packages))
+
+	for _, info := range binfo.Packages {
+		distro := &info.Distribution
+
+		if failed[distro.SourceName()] || !options.AutoRelease(distro, binfo.Info.Uid) {
+			continue
+		}
+
+		ids = append(ids, info.Id)
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	// Called with the builder lock held, releasing runs reprepro and the
+	// release hooks without it
+	stagefile := path.Base(binfo.Info.StageFile)
+
+	go func() {
+		released, err := x.releaseBuilds(ids, true)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to automatically release `%s': %s\n", stagefile, err)
+		} else if options.Verbose {
+			fmt.Printf("Automatically released %v builds of `%s'\n", len(released), stagefile)
+		}
+	}()
+}
+
+// builtDistribution returns whether the source package and the binary
+// packages of all architectures of a distribution finished building. Steps
+// are missing when a build failed in fail-fast mode, or when the source
+// version was already published.
+func (x *BuildInfo) builtDistribution(distro *Distribution) bool {
+	src := x.finishedStep(distro, "source")
+
+	if src == nil || len(src.Published) != 0 {
+		return false
+	}
+
+	for _, arch := range distro.Architectures {
+		if x.finishedStep(distro, arch) == nil {
+			return false
+		}
+	}
+
+	return true
+}
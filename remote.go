@@ -86,7 +86,7 @@ func RemoteConnect(socketfile string) (io.ReadWriteCloser, error) {
 	return nil, nil
 }
 
-func RemoteCall(method string, args interface{}, reply interface{}) error {
+func RemoteClient() (*rpc.Client, error) {
 	rwc, err := RemoteConnect("")
 
 	if err != nil {
@@ -94,7 +94,7 @@ func RemoteCall(method string, args interface{}, reply interface{}) error {
 			fmt.Printf("Failed to connect: %s\n", err)
 		}
 
-		return err
+		return nil, err
 	}
 
 	c := rpc.NewClient(rwc)
@@ -103,6 +103,16 @@ func RemoteCall(method string, args interface{}, reply interface{}) error {
 		fmt.Printf("Connected to remote daemon\n")
 	}
 
+	return c, nil
+}
+
+func RemoteCall(method string, args interface{}, reply interface{}) error {
+	c, err := RemoteClient()
+
+	if err != nil {
+		return err
+	}
+
 	if err := c.Call(method, args, reply); err != nil {
 		fmt.Printf("Failed to call remote method %v: %s\n", method, err)
 		return err
@@ -2,6 +2,7 @@ package main
 
 import (
 	"path"
+	"strings"
 	"sync"
 )
 
@@ -54,3 +55,42 @@ func clearVanishedRepReproLocked(distro *Distribution) error {
 
 	return RunCommand("reprepro", args...)
 }
+
+// publishedVersion returns the highest version of the source package name
+// published in the distribution, or nil if nothing is published.
+func publishedVersion(distro *Distribution, name string) (*DebianVersion, error) {
+	runReproMutex.Lock()
+	defer runReproMutex.Unlock()
+
+	args := repReproArgs(distro)
+	args = append(args, "listfilter", distro.CodeName, "$Source (== "+name+"), Package (== "+name+")")
+
+	out, err := RunOutputCommand("reprepro", args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ret *DebianVersion
+
+	// Lines look like `precise|main|source: example 1.0-1'
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) != 3 {
+			continue
+		}
+
+		v, err := ParseDebianVersion(fields[2])
+
+		if err != nil {
+			continue
+		}
+
+		if ret == nil || v.Compare(ret) > 0 {
+			ret = v
+		}
+	}
+
+	return ret, nil
+}
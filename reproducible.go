@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ReproducibleOptions struct {
+	// Build binary packages a second time with a varied build path, time
+	// zone, umask and clock, and compare the results
+	Enabled bool `json:"enabled"`
+
+	// Distribution patterns (e.g. ubuntu/* or debian/stable) to check, all
+	// distributions when empty
+	Distributions []string `json:"distributions,omitempty"`
+}
+
+type ReproducibleResult struct {
+	Reproducible bool
+
+	// The differing files of unreproducible builds, e.g.
+	// `example_1.0-1_amd64.deb: ./usr/bin/example (content)'
+	Differences []string `json:",omitempty"`
+
+	// Set when the second build failed
+	Error string `json:",omitempty"`
+}
+
+// The maximum number of differences recorded for a build
+const maxReproducibleDifferences = 50
+
+func (x *ReproducibleOptions) enabled(distro *Distribution) bool {
+	if !x.Enabled {
+		return false
+	}
+
+	if len(x.Distributions) == 0 {
+		return true
+	}
+
+	for _, pattern := range x.Distributions {
+		if ok, _ := path.Match(pattern, distro.SourceName()); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (x *ReproducibleResult) String() string {
+	if len(x.Error) != 0 {
+		return "not checked: " + x.Error
+	}
+
+	if x.Reproducible {
+		return "reproducible"
+	}
+
+	return fmt.Sprintf("unreproducible (%v differences)", len(x.Differences))
+}
+
+func (x *ReproducibleResult) differ(format string, args ...interface{}) {
+	x.Reproducible = false
+
+	if len(x.Differences) < maxReproducibleDifferences {
+		x.Differences = append(x.Differences, fmt.Sprintf(format, args...))
+	}
+}
+
+// readArMembers reads the members of an ar archive (e.g. a .deb), returning
+// their names in order and their checksums.
+func readArMembers(filename string) ([]string, map[string][sha256.Size]byte, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	magic := make([]byte, 8)
+
+	if _, err := io.ReadFull(rd, magic); err != nil || string(magic) != "!<arch>\n" {
+		return nil, nil, fmt.Errorf("`%s' is not an ar archive", path.Base(filename))
+	}
+
+	names := make([]string, 0)
+	sums := make(map[string][sha256.Size]byte)
+	header := make([]byte, 60)
+
+	for {
+		if _, err := io.ReadFull(rd, header); err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return nil, nil, err
+		}
+
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid ar member header in `%s'", path.Base(filename))
+		}
+
+		h := sha256.New()
+
+		if _, err := io.CopyN(h, rd, size); err != nil {
+			return nil, nil, err
+		}
+
+		// Members are aligned to even offsets
+		if size%2 != 0 {
+			rd.ReadByte()
+		}
+
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+
+		names = append(names, name)
+		sums[name] = sum
+	}
+
+	return names, sums, nil
+}
+
+type tarEntry struct {
+	header *tar.Header
+	sum    [sha256.Size]byte
+}
+
+// readDebTar reads the entries of the control (--ctrl-tarfile) or data
+// (--fsys-tarfile) archive of a .deb.
+func readDebTar(filename string, which string) (map[string]*tarEntry, error) {
+	out, err := RunOutputCommand("dpkg-deb", which, filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]*tarEntry)
+	rd := tar.NewReader(bytes.NewReader(out))
+
+	for {
+		header, err := rd.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha256.New()
+
+		if _, err := io.Copy(h, rd); err != nil {
+			return nil, err
+		}
+
+		entry := &tarEntry{header: header}
+		copy(entry.sum[:], h.Sum(nil))
+
+		ret[header.Name] = entry
+	}
+
+	return ret, nil
+}
+
+func compareTarEntries(a *tarEntry, b *tarEntry) []string {
+	ret := make([]string, 0)
+
+	ha := a.header
+	hb := b.header
+
+	if a.sum != b.sum || ha.Linkname != hb.Linkname {
+		ret = append(ret, "content")
+	}
+
+	if ha.Mode != hb.Mode {
+		ret = append(ret, fmt.Sprintf("mode %o != %o", ha.Mode, hb.Mode))
+	}
+
+	if ha.Uid != hb.Uid || ha.Gid != hb.Gid || ha.Uname != hb.Uname || ha.Gname != hb.Gname {
+		ret = append(ret, "owner")
+	}
+
+	if !ha.ModTime.Equal(hb.ModTime) {
+		ret = append(ret, "mtime")
+	}
+
+	return ret
+}
+
+// compareDebs compares two builds of a .deb member by member, and the files
+// of differing control and data members.
+func compareDebs(result *ReproducibleResult, first string, second string) error {
+	name := path.Base(first)
+
+	names, sums, err := readArMembers(first)
+
+	if err != nil {
+		return err
+	}
+
+	names2, sums2, err := readArMembers(second)
+
+	if err != nil {
+		return err
+	}
+
+	if strings.Join(names, " ") != strings.Join(names2, " ") {
+		result.differ("%s: members %s != %s", name, strings.Join(names, ", "), strings.Join(names2, ", "))
+		return nil
+	}
+
+	for _, member := range names {
+		if sums[member] == sums2[member] {
+			continue
+		}
+
+		which := ""
+
+		if strings.HasPrefix(member, "control.tar") {
+			which = "--ctrl-tarfile"
+		} else if strings.HasPrefix(member, "data.tar") {
+			which = "--fsys-tarfile"
+		} else {
+			result.differ("%s: %s", name, member)
+			continue
+		}
+
+		entries, err := readDebTar(first, which)
+
+		if err != nil {
+			return err
+		}
+
+		entries2, err := readDebTar(second, which)
+
+		if err != nil {
+			return err
+		}
+
+		ndiff := len(result.Differences)
+
+		for _, fname := range sortedKeys(entries) {
+			entry2, ok := entries2[fname]
+
+			if !ok {
+				result.differ("%s: %s (only in the first build)", name, fname)
+			} else if diffs := compareTarEntries(entries[fname], entry2); len(diffs) != 0 {
+				result.differ("%s: %s (%s)", name, fname, strings.Join(diffs, ", "))
+			}
+		}
+
+		for _, fname := range sortedKeys(entries2) {
+			if _, ok := entries[fname]; !ok {
+				result.differ("%s: %s (only in the second build)", name, fname)
+			}
+		}
+
+		// The files are equal, but the archive is not (e.g. compression
+		// or the order of files)
+		if len(result.Differences) == ndiff && ndiff < maxReproducibleDifferences {
+			result.differ("%s: %s (archive)", name, member)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(entries map[string]*tarEntry) []string {
+	ret := make([]string, 0, len(entries))
+
+	for k, _ := range entries {
+		ret = append(ret, k)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// checkReproducible builds the binary packages of a successful binary
+// build a second time, with a different build path, time zone and umask
+// (see pbuilderrc) and with the clock shifted into the future (see the
+// A20autobuild-vary hook), and compares the resulting .deb files with those
+// of the first build. The verdict is recorded on the build and the output is
+// appended to the build log.
+func (x *PackageBuilder) checkReproducible(binfo *BuildInfo, info *DistroBuildInfo, distro *Distribution, arch string, debBuildOpt string, localrepo string) {
+	if !binfo.Package.Options.Reproducible.enabled(distro) {
+		return
+	}
+
+	info.Reproducible = &ReproducibleResult{}
+
+	fmt.Fprintf(info.output, "\nBuilding again to check reproducibility...\n")
+
+	builddir := path.Join(binfo.Package.Dir, "reproducible", distro.Os, distro.CodeName, arch)
+	pkgdir := path.Join(builddir, path.Base(binfo.sourceDir(distro, arch)))
+	resultsdir := binfo.resultsDir(distro, arch) + "-reproducible"
+
+	defer os.RemoveAll(builddir)
+	defer os.RemoveAll(resultsdir)
+
+	err := checkPbuilderSupport("reproducibility checks", "AUTOBUILD_VARY_BUILD", "A20autobuild-vary")
+
+	if err == nil {
+		err = x.extractSourcePackageIn(binfo, distro, builddir, pkgdir)
+	}
+
+	if err == nil {
+		os.RemoveAll(resultsdir)
+		os.MkdirAll(resultsdir, 0755)
+
+		cmd := x.binaryBuildCommand(info, distro, arch, debBuildOpt, pkgdir, resultsdir, localrepo)
+		cmd.Env = append(cmd.Env, "AUTOBUILD_VARY_BUILD=1")
+
+		err = x.runBuildCommand(binfo, cmd, binfo.Package.Timeout(distro, TimeoutBinary))
+	}
+
+	if err != nil {
+		info.Reproducible.Error = err.Error()
+		fmt.Fprintf(info.output, "Reproducibility: %s\n", info.Reproducible)
+		return
+	}
+
+	info.Reproducible.Reproducible = true
+	built := make(map[string]bool)
+
+	for _, f := range info.Files {
+		if !strings.HasSuffix(f, ".deb") {
+			continue
+		}
+
+		built[path.Base(f)] = true
+
+		second := path.Join(resultsdir, path.Base(f))
+
+		if _, err := os.Stat(second); err != nil {
+			info.Reproducible.differ("%s (only in the first build)", path.Base(f))
+			continue
+		}
+
+		if err := compareDebs(info.Reproducible, f, second); err != nil {
+			info.Reproducible.Reproducible = false
+			info.Reproducible.Error = fmt.Sprintf("Failed to compare `%s': %s", path.Base(f), err)
+			break
+		}
+	}
+
+	if d, err := os.Open(resultsdir); err == nil {
+		names, _ := d.Readdirnames(0)
+		d.Close()
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			if strings.HasSuffix(name, ".deb") && !built[name] {
+				info.Reproducible.differ("%s (only in the second build)", name)
+			}
+		}
+	}
+
+	fmt.Fprintf(info.output, "Reproducibility: %s\n", info.Reproducible)
+
+	for _, d := range info.Reproducible.Differences {
+		fmt.Fprintf(info.output, "  %s\n", d)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+)
+
+type CommandRetry struct {
+}
+
+func (x *CommandRetry) showFailed() error {
+	a := &Incoming{}
+	ret := &IncomingReply{}
+
+	if err := RemoteCall("DaemonCommands.Incoming", a, ret); err != nil {
+		return err
+	}
+
+	n := 0
+
+	for _, r := range ret.Packages {
+		if len(r.Error) == 0 {
+			continue
+		}
+
+		if n == 0 {
+			fmt.Println("Failed builds:")
+			fmt.Println()
+		}
+
+		fmt.Printf("  %5d) %s/%s %s %s\n",
+			r.Id,
+			r.Distribution.Os,
+			r.Distribution.CodeName,
+			r.Distribution.Architectures[0],
+			path.Base(r.Name))
+
+		fmt.Printf("         %s\n", r.Error)
+		n++
+	}
+
+	if n == 0 {
+		fmt.Println("There are no failed builds to retry...")
+	} else {
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func (x *CommandRetry) Execute(args []string) error {
+	if len(args) == 0 {
+		return x.showFailed()
+	}
+
+	ids := make([]uint64, 0, len(args))
+
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("Invalid build id `%s'", arg)
+		}
+
+		ids = append(ids, id)
+	}
+
+	rt := &Retry{
+		Packages: ids,
+	}
+
+	return RemoteCall("DaemonCommands.Retry", rt, &RetryReply{})
+}
+
+func init() {
+	parser.AddCommand("retry",
+		"Retry failed builds",
+		"The retry command builds failed build steps again, without staging the package again. Without arguments, the failed builds and their ids are listed. Specify the ids of failed builds to queue them to be built again. Only the failed distribution architectures are built again, the results of successful builds of the same package are kept.",
+		&CommandRetry{})
+}
@@ -2,9 +2,38 @@ package main
 
 import (
 	"io/ioutil"
+	"path"
+	"strings"
 )
 
 type CommandStage struct {
+	Priority      int      `short:"p" long:"priority" description:"The build priority of the staged packages (higher priorities are built first)" default:"0"`
+	Distributions []string `short:"d" long:"dist" description:"Only build for the specified distribution (e.g. ubuntu/precise) or distribution architecture (e.g. ubuntu/precise/amd64). Can be specified multiple times"`
+	Force         bool     `short:"f" long:"force" description:"Build the packages even if the results of a build with identical inputs are cached, or the exact source version is already published"`
+}
+
+// readDscFiles reads the files referenced by a source package, which are
+// expected next to the .dsc.
+func (x *CommandStage) readDscFiles(filename string) (map[string][]byte, error) {
+	dsc, err := ParseDscFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]byte)
+
+	for _, name := range dsc.Files() {
+		data, err := ioutil.ReadFile(path.Join(path.Dir(filename), name))
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret[name] = data
+	}
+
+	return ret, nil
 }
 
 func (x *CommandStage) Execute(args []string) error {
@@ -17,8 +46,17 @@ func (x *CommandStage) Execute(args []string) error {
 		}
 
 		a := &Stage{
-			Filename: arg,
-			Data:     data,
+			Filename:      arg,
+			Data:          data,
+			Priority:      x.Priority,
+			Distributions: x.Distributions,
+			Force:         x.Force,
+		}
+
+		if strings.HasSuffix(arg, ".dsc") {
+			if a.Files, err = x.readDscFiles(arg); err != nil {
+				return err
+			}
 		}
 
 		ret := &StageReply{}
@@ -34,6 +72,6 @@ func (x *CommandStage) Execute(args []string) error {
 func init() {
 	parser.AddCommand("stage",
 		"Stage a package to be built in the build daemon",
-		"The stage command stages a package to be built. The staged package has a very specific layout. If your package original tarball is named example-1.0.tar.gz, then the autobuild package needs to be named example_1.0.tar.gz and contain example_1.0.orig.tar.gz and example_1.0.diff.gz. An optional patches/ directory may contain distribution specific patches (e.g. lucid.gz, precise.gz) to be applied per distribution.",
+		"The stage command stages a package to be built. Either a Debian source package (.dsc) or a package with the autobuild layout can be staged. The files referenced by a source package (e.g. example_1.0.orig.tar.gz and example_1.0-1.debian.tar.xz) are staged with it and are expected next to the .dsc file. Their checksums are verified before the package is queued. Build options and distribution specific patches of source packages are read from debian/autobuild/options and debian/autobuild/patches. The autobuild layout is very specific. If your package original tarball is named example-1.0.tar.gz, then the autobuild package needs to be named example_1.0.tar.gz and contain example_1.0.orig.tar.gz and example_1.0.diff.gz. An optional patches/ directory may contain distribution specific patches (e.g. lucid.gz, precise.gz) to be applied per distribution. Packages with a higher priority (-p, --priority) are built before packages with a lower priority. A failed build does not prevent the other distributions and architectures of the package from being built, unless \"fail-fast\" is set in the build options of the package. The distributions to build for can be selected when staging (-d, --dist), overriding the distributions in the build options. Selected distributions must be configured in the build daemon. Queued packages which build-depend on other queued packages are built after them. If \"local-dependencies\" is set in the build options, the packages built for these dependencies are available to the build before they are released. The results of successful builds are cached by a hash of their inputs (the staged files, the prepared source, the build options and the build environment). A build with identical inputs reuses the cached results instead of building again, and staging a source version which is already published in a distribution reports the published version instead of building it, while staging a version older than the published version is refused. Use -f, --force to build anyway. The \"environment\" build option customizes the build environment of the package: \"deb-build-options\" and \"deb-build-profiles\" (e.g. nocheck, nodoc) set DEB_BUILD_OPTIONS and DEB_BUILD_PROFILES, \"env\" sets extra environment variables of debian/rules (only inside the build environment), \"extra-packages\" are installed before building, \"apt-sources\" add sources.list lines with an optional ASCII armored \"key\", and \"network\" allows network access during the build. Settings for a distribution (e.g. ubuntu/jammy) or distribution architecture (e.g. ubuntu/jammy/arm64) in its \"distributions\" are added to the general settings. The effective settings are recorded with each build.",
 		&CommandStage{})
 }
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type PackageBuilderState struct {
+	FinishedPackages []*BuildInfo
+	PackageQueue     []*PackageInfo
+	PackageId        uint64
+	Policy           SchedulePolicy
+
+	// Packages which were building, with the steps which have finished
+	Building []*BuildInfo
+
+	// The sequence number of the last journal entry contained in this state
+	Sequence uint64
+}
+
+type journalOp string
+
+const (
+	journalQueue   journalOp = "queue"
+	journalRemove  journalOp = "remove"
+	journalMove    journalOp = "move"
+	journalStep    journalOp = "step"
+	journalFinish  journalOp = "finish"
+	journalRetry   journalOp = "retry"
+	journalRelease journalOp = "release"
+	journalDiscard journalOp = "discard"
+	journalPolicy  journalOp = "policy"
+)
+
+// The number of journal entries after which the complete state is written
+const checkpointEntries = 100
+
+// The interval at which the complete state is written if the journal is not
+// empty
+const checkpointInterval = 5 * time.Minute
+
+// The maximum size of a single journal entry, used to detect corruption
+const maxJournalEntrySize = 64 * 1024 * 1024
+
+// journalEntry records a single mutation of the builder state. Mutations
+// are written to the journal as they happen, and replayed on top of the
+// last checkpoint when loading the state.
+type journalEntry struct {
+	Sequence uint64
+	Op       journalOp
+
+	Package *PackageInfo
+	Build   *BuildInfo
+	Step    *DistroBuildInfo
+	Ids     []uint64
+	Offset  int
+	Policy  SchedulePolicy
+}
+
+func stateFile() string {
+	return path.Join(options.Base, "run", "builder.state")
+}
+
+func stateBackupFile() string {
+	return stateFile() + ".old"
+}
+
+func journalFile() string {
+	return path.Join(options.Base, "run", "builder.journal")
+}
+
+func fileOwner(fi os.FileInfo) uint32 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid
+	}
+
+	return 0
+}
+
+func (x *PackageBuilder) appendJournal(entry *journalEntry) error {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+
+	os.MkdirAll(path.Dir(journalFile()), 0755)
+
+	f, err := os.OpenFile(journalFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	// Entries are prefixed with their size so that a partially written
+	// entry at the end of the journal can be detected
+	data := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(data, uint32(buf.Len()))
+	data = append(data, buf.Bytes()...)
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func readJournal() ([]*journalEntry, error) {
+	f, err := os.Open(journalFile())
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	ret := make([]*journalEntry, 0)
+
+	for {
+		var size uint32
+
+		if err := binary.Read(rd, binary.BigEndian, &size); err != nil {
+			break
+		}
+
+		if size > maxJournalEntrySize {
+			return ret, fmt.Errorf("Corrupt journal entry after %v entries", len(ret))
+		}
+
+		data := make([]byte, size)
+
+		// An incomplete entry at the end was never acknowledged and
+		// is ignored
+		if _, err := io.ReadFull(rd, data); err != nil {
+			break
+		}
+
+		entry := &journalEntry{}
+
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry); err != nil {
+			return ret, err
+		}
+
+		ret = append(ret, entry)
+	}
+
+	return ret, nil
+}
+
+// journal records a mutation of the builder state. It must be called
+// with the builder locked.
+func (x *PackageBuilder) journal(entry *journalEntry) {
+	x.journalSequence++
+	entry.Sequence = x.journalSequence
+
+	if err := x.appendJournal(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write builder journal: %s\n", err)
+
+		// Try to write the complete state instead
+		if err := x.checkpoint(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save builder state: %s\n", err)
+		}
+
+		return
+	}
+
+	x.journalEntries++
+
+	if x.journalEntries >= checkpointEntries {
+		if err := x.checkpoint(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save builder state: %s\n", err)
+		}
+	}
+}
+
+// checkpoint writes the complete builder state and truncates the journal.
+// It must be called with the builder locked.
+func (x *PackageBuilder) checkpoint() error {
+	state := PackageBuilderState{
+		FinishedPackages: x.FinishedPackages,
+		PackageQueue:     x.PackageQueue,
+		PackageId:        x.PackageId,
+		Policy:           x.Policy,
+		Sequence:         x.journalSequence,
+	}
+
+	// Packages which are currently building are built again after a
+	// restart
+	if len(x.CurrentlyBuilding) != 0 {
+		state.PackageQueue = append(x.CurrentlyBuilding.Sorted(), state.PackageQueue...)
+	}
+
+	for _, info := range x.CurrentlyBuilding.Sorted() {
+		state.Building = append(state.Building, x.building[info.Id].resumeInfo())
+	}
+
+	// Packages which have not been resumed yet after the last restart
+	for _, binfo := range x.resumable {
+		state.Building = append(state.Building, binfo)
+	}
+
+	filename := stateFile()
+
+	// Keep the previous state in case the new one turns out to be
+	// unreadable
+	os.Remove(stateBackupFile())
+	os.Link(filename, stateBackupFile())
+
+	err := WriteFileAtomic(filename, func(writer io.Writer) error {
+		return gob.NewEncoder(writer).Encode(state)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// All journal entries are contained in the state now. Entries which
+	// remain because we fail to remove the journal are skipped by their
+	// sequence number when loading.
+	os.Remove(journalFile())
+	x.journalEntries = 0
+
+	return nil
+}
+
+func readState(filename string) (*PackageBuilderState, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	state := &PackageBuilderState{}
+
+	if err := gob.NewDecoder(f).Decode(state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (x *PackageBuilder) reserveId(id uint64) {
+	if id > x.PackageId {
+		x.PackageId = id
+	}
+}
+
+func (x *PackageBuilder) addFinished(binfo *BuildInfo) {
+	x.FinishedPackages = append(x.FinishedPackages, binfo)
+
+	for _, p := range binfo.Packages {
+		x.BuildInfoMap[p.Id] = binfo
+		x.reserveId(p.Id)
+	}
+}
+
+// resumeInfo returns the part of a building package which is needed to
+// resume building it after a restart.
+func (x *BuildInfo) resumeInfo() *BuildInfo {
+	ret := &BuildInfo{
+		Info:     x.Info,
+		Error:    x.Error,
+		Started:  x.Started,
+		Packages: make(DistroBuildInfoMap),
+		Retries:  x.Retries,
+	}
+
+	for id, info := range x.Packages {
+		ret.Packages[id] = info
+	}
+
+	return ret
+}
+
+func (x *PackageBuilder) replay(entry *journalEntry) {
+	switch entry.Op {
+	case journalQueue:
+		if entry.Package != nil && x.findQueued(entry.Package.Id) == -1 {
+			x.PackageQueue = append(x.PackageQueue, entry.Package)
+			x.reserveId(entry.Package.Id)
+		}
+	case journalRemove:
+		for _, id := range entry.Ids {
+			if i := x.findQueued(id); i != -1 {
+				x.PackageQueue = append(x.PackageQueue[:i], x.PackageQueue[i+1:]...)
+			}
+		}
+	case journalMove:
+		for _, id := range entry.Ids {
+			if i := x.findQueued(id); i != -1 {
+				x.moveQueued(i, entry.Offset)
+			}
+		}
+	case journalStep:
+		if entry.Step == nil || len(entry.Ids) != 1 {
+			return
+		}
+
+		binfo := x.resumable[entry.Ids[0]]
+
+		if binfo == nil {
+			i := x.findQueued(entry.Ids[0])
+
+			if i == -1 {
+				return
+			}
+
+			binfo = &BuildInfo{
+				Info:     x.PackageQueue[i],
+				Packages: make(DistroBuildInfoMap),
+				Started:  entry.Step.Started,
+			}
+
+			x.resumable[binfo.Info.Id] = binfo
+		}
+
+		if entry.Step.Error != nil {
+			binfo.Error = entry.Step.Error
+		}
+
+		binfo.Packages[entry.Step.Id] = entry.Step
+		x.reserveId(entry.Step.Id)
+	case journalFinish:
+		if entry.Build == nil || entry.Build.Info == nil {
+			return
+		}
+
+		delete(x.resumable, entry.Build.Info.Id)
+
+		if i := x.findQueued(entry.Build.Info.Id); i != -1 {
+			x.PackageQueue = append(x.PackageQueue[:i], x.PackageQueue[i+1:]...)
+		}
+
+		x.reserveId(entry.Build.Info.Id)
+		x.addFinished(entry.Build)
+	case journalRetry:
+		steps := make([]*DistroBuildInfo, 0, len(entry.Ids))
+		var build *BuildInfo
+
+		for _, id := range entry.Ids {
+			if binfo, info := x.FindPackage(id); info != nil {
+				build = binfo
+				steps = append(steps, info)
+			}
+		}
+
+		if build != nil {
+			x.retrySteps(build, steps)
+		}
+	case journalRelease, journalDiscard:
+		x.foreachMatchedId(entry.Ids, func(info *BuildInfo, binfo *DistroBuildInfo) error {
+			return nil
+		})
+
+		x.removeFinished()
+	case journalPolicy:
+		if entry.Policy.IsValid() {
+			x.Policy = entry.Policy
+		}
+	}
+}
+
+// pruneFinished removes finished builds of which the results no longer
+// exist, for example because they were released right before a crash.
+func (x *PackageBuilder) pruneFinished() {
+	for _, binfo := range x.FinishedPackages {
+		for id, info := range binfo.Packages {
+			if len(info.Changes) == 0 {
+				continue
+			}
+
+			if _, err := os.Stat(info.Changes + ".changes"); os.IsNotExist(err) {
+				delete(binfo.Packages, id)
+				delete(x.BuildInfoMap, id)
+			}
+		}
+	}
+
+	x.removeFinished()
+}
+
+// pruneResumable removes the finished steps of packages to be resumed of
+// which the results no longer exist, so that they are built again.
+func (x *PackageBuilder) pruneResumable() {
+	for id, binfo := range x.resumable {
+		if x.findQueued(id) == -1 {
+			delete(x.resumable, id)
+			continue
+		}
+
+		for sid, info := range binfo.Packages {
+			if info.Error != nil {
+				continue
+			}
+
+			if _, err := os.Stat(info.Changes + ".changes"); err != nil {
+				delete(binfo.Packages, sid)
+			}
+		}
+	}
+}
+
+// recoverStaged queues staged packages which are not part of the state.
+func (x *PackageBuilder) recoverStaged() {
+	files, _ := filepath.Glob(path.Join(options.Base, "stage", "*"))
+
+	for _, filename := range files {
+		name := path.Base(filename)
+		queued := false
+
+		for _, info := range x.PackageQueue {
+			if info.MatchStageFile(name) {
+				queued = true
+				break
+			}
+		}
+
+		// Stage files of failed builds are kept to retry them
+		for _, binfo := range x.FinishedPackages {
+			if binfo.Info.MatchStageFile(name) {
+				queued = true
+				break
+			}
+		}
+
+		fi, err := os.Stat(filename)
+
+		if queued || err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		info := NewPackageInfo(filename, fileOwner(fi))
+
+		if info == nil {
+			continue
+		}
+
+		info.Id = atomic.AddUint64(&x.PackageId, 1)
+		info.ReadDependencies()
+
+		x.PackageQueue = append(x.PackageQueue, info)
+
+		fmt.Fprintf(os.Stderr, "Recovered staged package `%s'\n", name)
+	}
+}
+
+// recoverIncoming adds build results in incoming/ which are not part of
+// the state to the finished packages, so that they can be released or
+// discarded.
+func (x *PackageBuilder) recoverIncoming() {
+	known := make(map[string]bool)
+
+	for _, binfo := range x.FinishedPackages {
+		for _, info := range binfo.Packages {
+			known[info.Changes+".changes"] = true
+		}
+	}
+
+	for _, binfo := range x.resumable {
+		for _, info := range binfo.Packages {
+			known[info.Changes+".changes"] = true
+		}
+	}
+
+	files, _ := filepath.Glob(path.Join(options.Base, "incoming", "*", "*", "*.changes"))
+	recovered := make(map[string]*BuildInfo)
+
+	for _, filename := range files {
+		if known[filename] {
+			continue
+		}
+
+		// <source>_<version>_<arch>.changes
+		parts := strings.Split(strings.TrimSuffix(path.Base(filename), ".changes"), "_")
+
+		if len(parts) != 3 {
+			continue
+		}
+
+		fi, err := os.Stat(filename)
+
+		if err != nil {
+			continue
+		}
+
+		incomingdir := path.Dir(filename)
+
+		info := &DistroBuildInfo{
+			IncomingDir: incomingdir,
+			Changes:     strings.TrimSuffix(filename, ".changes"),
+
+			Distribution: Distribution{
+				Os:            path.Base(path.Dir(incomingdir)),
+				CodeName:      path.Base(incomingdir),
+				Architectures: []string{parts[2]},
+			},
+
+			Finished: fi.ModTime(),
+		}
+
+		if err := x.parseChanges(info); err != nil {
+			continue
+		}
+
+		info.Id = atomic.AddUint64(&x.PackageId, 1)
+		info.Files = append([]string{filename}, info.ChangesFiles...)
+
+		key := parts[0] + "_" + parts[1]
+		binfo := recovered[key]
+
+		if binfo == nil {
+			binfo = &BuildInfo{
+				Info: &PackageInfo{
+					Id:        atomic.AddUint64(&x.PackageId, 1),
+					StageFile: key,
+					Name:      parts[0],
+					Version:   parts[1],
+					Uid:       fileOwner(fi),
+				},
+
+				Packages: make(DistroBuildInfoMap),
+				Finished: fi.ModTime(),
+			}
+
+			recovered[key] = binfo
+			x.FinishedPackages = append(x.FinishedPackages, binfo)
+		}
+
+		binfo.Packages[info.Id] = info
+		x.BuildInfoMap[info.Id] = binfo
+
+		fmt.Fprintf(os.Stderr, "Recovered build results `%s'\n", path.Base(filename))
+	}
+}
+
+func (x *PackageBuilder) Save() error {
+	return x.Do(func(b *PackageBuilder) error {
+		return b.checkpoint()
+	})
+}
+
+// Load restores the builder state from the last checkpoint and the
+// journal. If the checkpoint is unreadable, the state is recovered from
+// the previous checkpoint, the journal and the staged and built packages
+// on disk.
+func (x *PackageBuilder) Load() error {
+	return x.Do(func(b *PackageBuilder) error {
+		recover := false
+		state, err := readState(stateFile())
+
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Failed to read builder state, trying to recover: %s\n", err)
+
+			recover = true
+			state, err = readState(stateBackupFile())
+		}
+
+		if err != nil {
+			state = &PackageBuilderState{}
+		}
+
+		b.PackageQueue = state.PackageQueue
+		b.PackageId = state.PackageId
+		b.journalSequence = state.Sequence
+
+		if state.Policy.IsValid() {
+			b.Policy = state.Policy
+		}
+
+		for _, info := range state.FinishedPackages {
+			b.addFinished(info)
+		}
+
+		for _, binfo := range state.Building {
+			b.resumable[binfo.Info.Id] = binfo
+
+			for _, info := range binfo.Packages {
+				b.reserveId(info.Id)
+			}
+		}
+
+		entries, err := readJournal()
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read builder journal, trying to recover: %s\n", err)
+			recover = true
+		}
+
+		for _, entry := range entries {
+			if entry.Sequence > state.Sequence {
+				b.replay(entry)
+			}
+
+			if entry.Sequence > b.journalSequence {
+				b.journalSequence = entry.Sequence
+			}
+		}
+
+		// Packages queued by older versions do not have an id yet
+		for _, info := range b.PackageQueue {
+			if info.Id == 0 {
+				info.Id = atomic.AddUint64(&b.PackageId, 1)
+			}
+		}
+
+		b.pruneFinished()
+		b.pruneResumable()
+
+		if recover {
+			b.recoverStaged()
+			b.recoverIncoming()
+		}
+
+		if len(b.PackageQueue) > 0 {
+			b.notify()
+		}
+
+		// Start with a fresh checkpoint of the restored state
+		return b.checkpoint()
+	})
+}
+
+func (x *PackageBuilder) RunCheckpoints() {
+	for {
+		time.Sleep(checkpointInterval)
+
+		x.Do(func(b *PackageBuilder) error {
+			if b.journalEntries == 0 {
+				return nil
+			}
+
+			if err := b.checkpoint(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to save builder state: %s\n", err)
+			}
+
+			return nil
+		})
+	}
+}
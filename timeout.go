@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type TimeoutKind int
+
+const (
+	TimeoutExtract TimeoutKind = iota
+	TimeoutSource
+	TimeoutBinary
+)
+
+// The time given to a build to terminate after it timed out or was
+// cancelled, before it is killed
+var killGracePeriod = 30 * time.Second
+
+type BuildTimeouts struct {
+	Extract int `json:"extract,omitempty" description:"The timeout (in seconds) for extracting a package"`
+	Source  int `json:"source,omitempty" description:"The timeout (in seconds) for building a source package"`
+	Binary  int `json:"binary,omitempty" description:"The timeout (in seconds) for building the binary packages of a single architecture"`
+}
+
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (x *TimeoutError) Error() string {
+	return fmt.Sprintf("The build timed out after %v", x.Timeout)
+}
+
+func (x BuildTimeouts) Duration(kind TimeoutKind) time.Duration {
+	var secs int
+
+	switch kind {
+	case TimeoutExtract:
+		secs = x.Extract
+	case TimeoutSource:
+		secs = x.Source
+	case TimeoutBinary:
+		secs = x.Binary
+	}
+
+	return time.Duration(secs) * time.Second
+}
+
+func (x BuildTimeouts) Override(other *BuildTimeouts) BuildTimeouts {
+	if other == nil {
+		return x
+	}
+
+	if other.Extract != 0 {
+		x.Extract = other.Extract
+	}
+
+	if other.Source != 0 {
+		x.Source = other.Source
+	}
+
+	if other.Binary != 0 {
+		x.Binary = other.Binary
+	}
+
+	return x
+}
+
+func (x *ExtractedPackage) Timeout(distro *Distribution, kind TimeoutKind) time.Duration {
+	// Package options override distribution settings, which override the
+	// global settings
+	timeouts := options.Builder.Timeouts
+
+	if distrocfg := options.BuildOptions.FindDistribution(distro); distrocfg != nil {
+		timeouts = timeouts.Override(distrocfg.Timeouts)
+	}
+
+	timeouts = timeouts.Override(&x.Options.Timeouts)
+	return timeouts.Duration(kind)
+}
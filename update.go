@@ -41,6 +41,11 @@ func (x *CommandUpdate) Execute(args []string) error {
 					arch)
 			}
 
+			if crossBuilt(distro, arch) {
+				return fmt.Errorf("The architecture `%s' is cross-built in the build environment of the host architecture, update that environment instead.",
+					arch)
+			}
+
 			archvar := fmt.Sprintf("ARCH=%s", arch)
 
 			cmd.Env = os.Environ()
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DebianVersion is a Debian package version of the form
+// [epoch:]upstream[-revision].
+type DebianVersion struct {
+	Epoch    int
+	Upstream string
+	Revision string
+}
+
+var changelogHeaderRegex *regexp.Regexp
+
+func isVersionChar(c byte, extra string) bool {
+	return (c >= '0' && c <= '9') ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		strings.IndexByte(".+~"+extra, c) != -1
+}
+
+func ParseDebianVersion(version string) (*DebianVersion, error) {
+	s := strings.TrimSpace(version)
+	ret := &DebianVersion{}
+
+	if len(s) == 0 {
+		return nil, fmt.Errorf("Invalid version `%s': version is empty", version)
+	}
+
+	if i := strings.Index(s, ":"); i != -1 {
+		epoch, err := strconv.ParseUint(s[:i], 10, 31)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version `%s': epoch is not a number", version)
+		}
+
+		ret.Epoch = int(epoch)
+		s = s[i+1:]
+	}
+
+	if i := strings.LastIndex(s, "-"); i != -1 {
+		ret.Revision = s[i+1:]
+		s = s[:i]
+
+		if len(ret.Revision) == 0 {
+			return nil, fmt.Errorf("Invalid version `%s': revision is empty", version)
+		}
+	}
+
+	ret.Upstream = s
+
+	if len(s) == 0 || s[0] < '0' || s[0] > '9' {
+		return nil, fmt.Errorf("Invalid version `%s': upstream version must start with a digit", version)
+	}
+
+	for i := 0; i < len(ret.Upstream); i++ {
+		if !isVersionChar(ret.Upstream[i], "-:") {
+			return nil, fmt.Errorf("Invalid version `%s': invalid character `%c' in upstream version", version, ret.Upstream[i])
+		}
+	}
+
+	for i := 0; i < len(ret.Revision); i++ {
+		if !isVersionChar(ret.Revision[i], "") {
+			return nil, fmt.Errorf("Invalid version `%s': invalid character `%c' in revision", version, ret.Revision[i])
+		}
+	}
+
+	return ret, nil
+}
+
+func (x *DebianVersion) String() string {
+	ret := x.Upstream
+
+	if x.Epoch != 0 {
+		ret = fmt.Sprintf("%d:%s", x.Epoch, ret)
+	}
+
+	if len(x.Revision) != 0 {
+		ret += "-" + x.Revision
+	}
+
+	return ret
+}
+
+// WithSuffix returns the version with suffix appended to the revision, or
+// to the upstream version of native packages (separated by a `+' unless
+// the suffix starts with a separator itself).
+func (x *DebianVersion) WithSuffix(suffix string) *DebianVersion {
+	ret := *x
+
+	if len(ret.Revision) != 0 {
+		ret.Revision += suffix
+	} else if len(suffix) != 0 && strings.IndexByte(".+~", suffix[0]) != -1 {
+		ret.Upstream += suffix
+	} else {
+		ret.Upstream += "+" + suffix
+	}
+
+	return &ret
+}
+
+func versionCharOrder(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return 0
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return int(c)
+	case c == '~':
+		return -1
+	}
+
+	return int(c) + 256
+}
+
+func isDigit(s string, i int) bool {
+	return i < len(s) && s[i] >= '0' && s[i] <= '9'
+}
+
+// compareVersionPart compares upstream versions or revisions like dpkg
+// does: non-digit parts are compared lexically (with letters sorting
+// before non-letters and `~' before anything, even the end of the part),
+// digit parts are compared numerically.
+func compareVersionPart(a string, b string) int {
+	i, j := 0, 0
+
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a, i)) || (j < len(b) && !isDigit(b, j)) {
+			ac, bc := 0, 0
+
+			if i < len(a) {
+				ac = versionCharOrder(a[i])
+			}
+
+			if j < len(b) {
+				bc = versionCharOrder(b[j])
+			}
+
+			if ac != bc {
+				return ac - bc
+			}
+
+			i++
+			j++
+		}
+
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+
+		diff := 0
+
+		for isDigit(a, i) && isDigit(b, j) {
+			if diff == 0 {
+				diff = int(a[i]) - int(b[j])
+			}
+
+			i++
+			j++
+		}
+
+		if isDigit(a, i) {
+			return 1
+		}
+
+		if isDigit(b, j) {
+			return -1
+		}
+
+		if diff != 0 {
+			return diff
+		}
+	}
+
+	return 0
+}
+
+// Compare returns -1, 0 or 1 when x is respectively lower than, equal to
+// or greater than other.
+func (x *DebianVersion) Compare(other *DebianVersion) int {
+	ret := x.Epoch - other.Epoch
+
+	if ret == 0 {
+		ret = compareVersionPart(x.Upstream, other.Upstream)
+	}
+
+	if ret == 0 {
+		ret = compareVersionPart(x.Revision, other.Revision)
+	}
+
+	if ret < 0 {
+		return -1
+	} else if ret > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+type ChangelogHeader struct {
+	Name         string
+	Version      *DebianVersion
+	Distribution string
+
+	// Everything after the distribution (e.g. urgency=low)
+	Rest string
+}
+
+// ParseChangelogHeader parses the first line of a debian/changelog entry,
+// e.g. `example (1.0-1) UNRELEASED; urgency=low'. It returns nil if the
+// line is not an entry header.
+func ParseChangelogHeader(line string) *ChangelogHeader {
+	matched := changelogHeaderRegex.FindStringSubmatch(line)
+
+	if matched == nil {
+		return nil
+	}
+
+	version, err := ParseDebianVersion(matched[2])
+
+	if err != nil {
+		return nil
+	}
+
+	return &ChangelogHeader{
+		Name:         matched[1],
+		Version:      version,
+		Distribution: strings.TrimSpace(matched[3]),
+		Rest:         matched[4],
+	}
+}
+
+// ReadChangelogHeader reads the header of the top entry of a
+// debian/changelog.
+func ReadChangelogHeader(rd io.Reader) (*ChangelogHeader, error) {
+	scanner := bufio.NewScanner(rd)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if header := ParseChangelogHeader(line); header != nil {
+			return header, nil
+		}
+
+		break
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("Failed to parse the top entry of debian/changelog")
+}
+
+func (x *ChangelogHeader) String() string {
+	return fmt.Sprintf("%s (%s) %s;%s", x.Name, x.Version, x.Distribution, x.Rest)
+}
+
+func init() {
+	changelogHeaderRegex, _ = regexp.Compile(`^(\S+)\s+\(([^()\s]+)\)\s+([^;]+);(.*)$`)
+}
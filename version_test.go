@@ -0,0 +1,306 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDebianVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		epoch    int
+		upstream string
+		revision string
+	}{
+		{"1.0", 0, "1.0", ""},
+		{"1.0-1", 0, "1.0", "1"},
+		{"2:1.0-1", 2, "1.0", "1"},
+		{"1.0-rc1-1ubuntu2", 0, "1.0-rc1", "1ubuntu2"},
+		{"1:2.0~beta1+dfsg-3~bpo1", 1, "2.0~beta1+dfsg", "3~bpo1"},
+		{"1:2.0:3-1", 1, "2.0:3", "1"},
+		{" 1.0-1 ", 0, "1.0", "1"},
+	}
+
+	for _, test := range tests {
+		v, err := ParseDebianVersion(test.version)
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.version, err)
+			continue
+		}
+
+		if v.Epoch != test.epoch || v.Upstream != test.upstream || v.Revision != test.revision {
+			t.Errorf("%s: expected %v/%s/%s, got %v/%s/%s", test.version,
+				test.epoch, test.upstream, test.revision,
+				v.Epoch, v.Upstream, v.Revision)
+		}
+	}
+}
+
+func TestParseDebianVersionInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"a:1.0",
+		"-1:1.0",
+		"1.0-",
+		"a1.0",
+		":1.0",
+		"1.0_1",
+		"1.0-1:2",
+	}
+
+	for _, test := range tests {
+		if v, err := ParseDebianVersion(test); err == nil {
+			t.Errorf("%s: expected an error, got %s", test, v)
+		}
+	}
+}
+
+func TestDebianVersionString(t *testing.T) {
+	for _, version := range []string{"1.0", "1.0-1", "2:1.0-1", "0.9~rc1"} {
+		v, err := ParseDebianVersion(version)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s := v.String(); s != version {
+			t.Errorf("Expected %s, got %s", version, s)
+		}
+	}
+}
+
+func TestCompareVersionPart(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"", "", 0},
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.01", "1.1", 0},
+		{"1.001", "1.2", -1},
+		{"007", "7", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0a", "1.0.", -1},
+		{"1.0+", "1.0.", -1},
+		{"1.0Z", "1.0a", -1},
+		{"1ubuntu1", "1", 1},
+		{"1", "1precise0", -1},
+		{"1precise0", "1precise1", -1},
+		{"", "0", 0},
+		{"", "1", -1},
+		{"", "~", 1},
+	}
+
+	for _, test := range tests {
+		ret := compareVersionPart(test.a, test.b)
+
+		if ret < 0 {
+			ret = -1
+		} else if ret > 0 {
+			ret = 1
+		}
+
+		if ret != test.expected {
+			t.Errorf("compareVersionPart(%q, %q): expected %v, got %v", test.a, test.b, test.expected, ret)
+		}
+
+		// The comparison must be antisymmetric
+		if rev := compareVersionPart(test.b, test.a); (rev < 0 && ret != 1) || (rev > 0 && ret != -1) || (rev == 0 && ret != 0) {
+			t.Errorf("compareVersionPart(%q, %q) is not antisymmetric", test.b, test.a)
+		}
+	}
+}
+
+func TestDebianVersionCompare(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"1.0-1", "1.0-1", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1:1.0-1", "2.0-1", 1},
+		{"1:1.0", "0:1.0", 1},
+		{"0:1.0-1", "1.0-1", 0},
+		{"1.0", "1.0-0", 0},
+		{"1.0", "1.0-1", -1},
+		{"1.0-1~bpo1", "1.0-1", -1},
+		{"1.0~rc1-1", "1.0-1", -1},
+		{"1.0-1", "1.0-1precise0", -1},
+		{"1.0-1precise0", "1.0-1precise1", -1},
+		{"1.0-1~ubuntu22.04.1", "1.0-1", -1},
+		{"1.0+dfsg-1", "1.0-1", 1},
+		{"1.0-10", "1.0-9", 1},
+	}
+
+	for _, test := range tests {
+		a, err := ParseDebianVersion(test.a)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ParseDebianVersion(test.b)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ret := a.Compare(b); ret != test.expected {
+			t.Errorf("Compare(%s, %s): expected %v, got %v", test.a, test.b, test.expected, ret)
+		}
+
+		if ret := b.Compare(a); ret != -test.expected {
+			t.Errorf("Compare(%s, %s): expected %v, got %v", test.b, test.a, -test.expected, ret)
+		}
+	}
+}
+
+func TestDebianVersionWithSuffix(t *testing.T) {
+	tests := []struct {
+		version  string
+		suffix   string
+		expected string
+	}{
+		{"1.0-1", "precise0", "1.0-1precise0"},
+		{"1.0-1", "~ubuntu22.04.1", "1.0-1~ubuntu22.04.1"},
+		{"1:1.0-1", "jammy0", "1:1.0-1jammy0"},
+		{"1.0", "jammy0", "1.0+jammy0"},
+		{"1.0", "~jammy0", "1.0~jammy0"},
+		{"1.0", "", "1.0+"},
+	}
+
+	for _, test := range tests {
+		v, err := ParseDebianVersion(test.version)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s := v.WithSuffix(test.suffix).String(); s != test.expected {
+			t.Errorf("%s with suffix %s: expected %s, got %s", test.version, test.suffix, test.expected, s)
+		}
+	}
+}
+
+func TestSuffixedVersion(t *testing.T) {
+	tests := []struct {
+		suffix    string
+		version   string
+		published string
+		expected  string
+	}{
+		{"", "1.0-1", "", "1.0-1jammy0"},
+		{"", "1.0-1", "1.0-1", "1.0-1jammy0"},
+		{"", "1.0-1", "1.0-1jammy0", ""},
+		{"~ubuntu${version}.${build}", "1.0-1", "", "1.0-1~ubuntu22.04.1"},
+		{"~ubuntu${version}.${build}", "1.0-1", "1.0-1~ubuntu22.04.2", "1.0-1~ubuntu22.04.3"},
+		{"~ubuntu${version}.${build}", "1.0-1", "1.0-1", ""},
+	}
+
+	for _, test := range tests {
+		distro := &Distribution{
+			Os:            "ubuntu",
+			CodeName:      "jammy",
+			Version:       "22.04",
+			VersionSuffix: test.suffix,
+		}
+
+		version, _ := ParseDebianVersion(test.version)
+
+		var published *DebianVersion
+
+		if len(test.published) != 0 {
+			published, _ = ParseDebianVersion(test.published)
+		}
+
+		v, err := suffixedVersion(version, published, distro)
+
+		if len(test.expected) == 0 {
+			if err == nil {
+				t.Errorf("%s (published %s): expected an error, got %s", test.version, test.published, v)
+			}
+		} else if err != nil {
+			t.Errorf("%s (published %s): unexpected error: %s", test.version, test.published, err)
+		} else if v.String() != test.expected {
+			t.Errorf("%s (published %s): expected %s, got %s", test.version, test.published, test.expected, v)
+		}
+	}
+}
+
+func TestParseChangelogHeader(t *testing.T) {
+	tests := []struct {
+		line         string
+		name         string
+		version      string
+		distribution string
+		rest         string
+	}{
+		{"example (1.0-1) UNRELEASED; urgency=low", "example", "1.0-1", "UNRELEASED", " urgency=low"},
+		{"example (1:2.0~rc1-1ubuntu1) jammy-proposed; urgency=medium", "example", "1:2.0~rc1-1ubuntu1", "jammy-proposed", " urgency=medium"},
+		{"lib-example  (1.0)  unstable experimental;", "lib-example", "1.0", "unstable experimental", ""},
+	}
+
+	for _, test := range tests {
+		header := ParseChangelogHeader(test.line)
+
+		if header == nil {
+			t.Errorf("Failed to parse `%s'", test.line)
+			continue
+		}
+
+		if header.Name != test.name || header.Version.String() != test.version || header.Distribution != test.distribution || header.Rest != test.rest {
+			t.Errorf("`%s': unexpected header %q %q %q %q", test.line, header.Name, header.Version, header.Distribution, header.Rest)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"  * Initial release",
+		" -- Jane Doe <jane@example.com>  Mon, 01 Jan 2024 00:00:00 +0000",
+		"example (1.0-1) UNRELEASED urgency=low",
+		"example (a1.0) UNRELEASED; urgency=low",
+		"example (1.0 1) UNRELEASED; urgency=low",
+	}
+
+	for _, line := range invalid {
+		if header := ParseChangelogHeader(line); header != nil {
+			t.Errorf("Expected `%s' not to be a changelog header, got %s", line, header)
+		}
+	}
+}
+
+func TestReadChangelogHeader(t *testing.T) {
+	changelog := `
+example (1.0-2) UNRELEASED; urgency=low
+
+  * Fix the build
+
+ -- Jane Doe <jane@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+example (1.0-1) unstable; urgency=low
+`
+
+	header, err := ReadChangelogHeader(strings.NewReader(changelog))
+
+	if err != nil {
+		t.Fatalf("Failed to read the changelog header: %s", err)
+	}
+
+	if header.Name != "example" || header.Version.String() != "1.0-2" || header.Distribution != "UNRELEASED" {
+		t.Errorf("Unexpected changelog header %s", header)
+	}
+
+	if _, err := ReadChangelogHeader(strings.NewReader("  * Fix the build\n")); err == nil {
+		t.Errorf("Expected an error reading a changelog without a header")
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type WebQueueCommand struct {
@@ -46,12 +47,22 @@ func WebQueueServiceHandleQueue(w http.ResponseWriter, r *http.Request, uid uint
 			}
 		}
 
+		// The running steps are modified by the build workers, only a
+		// snapshot of them is encoded
+		steps := make(map[string][]QueuedStep)
+
+		for id, binfo := range b.building {
+			steps[fmt.Sprintf("%v", id)] = binfo.queuedSteps()
+		}
+
 		enc := json.NewEncoder(w)
 
 		return enc.Encode(map[string]interface{}{
 			"packages": packages,
 			"building": b.CurrentlyBuilding,
-			"queue":    b.PackageQueue,
+			"steps":    steps,
+			"queue":    b.scheduledQueue(),
+			"policy":   b.Policy,
 		})
 	})
 }
@@ -90,6 +101,11 @@ func WebQueueServiceHandleDiscard(w http.ResponseWriter, r *http.Request, uid ui
 	encodeWebPackages(w, pkgs, err)
 }
 
+func WebQueueServiceHandleRetry(w http.ResponseWriter, r *http.Request, uid uint32) {
+	pkgs, err := builder.Retry(decodeWebPackages(r, "/queue/retry/", uid), uid)
+	encodeWebPackages(w, pkgs, WrapError(err))
+}
+
 func WebQueueServiceHandleDownload(w http.ResponseWriter, r *http.Request, uid uint32) {
 	downprefix := "/queue/download/"
 
@@ -162,25 +178,89 @@ func WebQueueServiceHandleLog(w http.ResponseWriter, r *http.Request, uid uint32
 		return
 	}
 
-	var pkg *DistroBuildInfo
+	data, _, err := builder.ReadLog(id, 0, 0)
 
-	// Find package with this id
-	if err := builder.Do(func(b *PackageBuilder) error {
-		_, pkg = b.FindPackage(id)
-		return nil
-	}); err != nil {
+	if err == nil {
+		w.Header().Add("Content-type", "text/plain")
+		w.Write(data)
+	}
+}
+
+func WebQueueServiceHandleTail(w http.ResponseWriter, r *http.Request, uid uint32) {
+	tailprefix := "/queue/tail/"
+
+	id, err := strconv.ParseUint(r.URL.Path[len(tailprefix):], 10, 64)
+
+	if err != nil {
 		return
 	}
 
-	if pkg != nil {
-		w.Header().Add("Content-type", "text/plain")
-		io.WriteString(w, pkg.Log)
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	data, finished, err := builder.ReadLog(id, offset, 10*time.Second)
+
+	ret := struct {
+		Data     string
+		Offset   int
+		Finished bool
+		Error    error
+	}{
+		Data:     string(data),
+		Offset:   offset + len(data),
+		Finished: finished,
+		Error:    WrapError(err),
 	}
+
+	w.Header().Add("Content-type", "application/json")
+	json.NewEncoder(w).Encode(ret)
 }
 
-func WebQueueStage(file *multipart.FileHeader, uid uint32) (*PackageInfo, error) {
-	return builder.Stage(file.Filename, uid, func(b *PackageBuilder, writer io.Writer) error {
-		f, err := file.Open()
+func WebQueueServiceHandleHistory(w http.ResponseWriter, r *http.Request, uid uint32) {
+	q := r.URL.Query()
+
+	filter := &HistoryFilter{
+		Package:      q.Get("package"),
+		Distribution: q.Get("distribution"),
+		User:         q.Get("user"),
+		Status:       q.Get("status"),
+	}
+
+	if since, err := time.Parse("2006-01-02", q.Get("since")); err == nil {
+		filter.Since = since
+	}
+
+	if until, err := time.Parse("2006-01-02", q.Get("until")); err == nil {
+		filter.Until = until.Add(24 * time.Hour)
+	}
+
+	records, err := history.Query(filter)
+
+	ret := struct {
+		Records []*HistoryRecord
+		Error   error
+	}{
+		Records: records,
+		Error:   WrapError(err),
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+func WebQueueStage(file *multipart.FileHeader, files map[string]*multipart.FileHeader, uid uint32, distributions []string, force bool) (*PackageInfo, error) {
+	names := make([]string, 0, len(files))
+
+	for name, _ := range files {
+		names = append(names, name)
+	}
+
+	return builder.Stage(file.Filename, names, uid, 0, distributions, force, func(b *PackageBuilder, name string, writer io.Writer) error {
+		header := file
+
+		if name != file.Filename {
+			header = files[name]
+		}
+
+		f, err := header.Open()
 
 		if err != nil {
 			return err
@@ -204,10 +284,48 @@ func WebQueueServiceHandleStage(w http.ResponseWriter, r *http.Request, uid uint
 	}
 
 	ret := make(map[string]WebStageReply)
+	distributions := make([]string, 0)
+
+	for _, v := range r.MultipartForm.Value["distributions"] {
+		distributions = append(distributions, strings.Fields(strings.Replace(v, ",", " ", -1))...)
+	}
+
+	force := len(r.MultipartForm.Value["force"]) != 0 && r.MultipartForm.Value["force"][0] == "true"
+
+	// Files referenced by an uploaded source package (.dsc) are staged
+	// together with the source package
+	files := make(map[string]*multipart.FileHeader)
+	referenced := make(map[string]bool)
+
+	for _, headers := range r.MultipartForm.File {
+		for _, header := range headers {
+			files[header.Filename] = header
+		}
+	}
+
+	for name, header := range files {
+		if !strings.HasSuffix(name, ".dsc") {
+			continue
+		}
+
+		if f, err := header.Open(); err == nil {
+			if dsc, err := ParseDsc(f); err == nil {
+				for _, ref := range dsc.Files() {
+					referenced[ref] = true
+				}
+			}
+
+			f.Close()
+		}
+	}
 
 	for name, headers := range r.MultipartForm.File {
 		for _, header := range headers {
-			info, err := WebQueueStage(header, uid)
+			if referenced[header.Filename] {
+				continue
+			}
+
+			info, err := WebQueueStage(header, files, uid, distributions, force)
 
 			ret[name] = WebStageReply{
 				info,
@@ -276,6 +394,14 @@ func RunWebQueueService(filename string, uid uint32) (chan bool, error) {
 		WebQueueServiceHandleLog(w, r, uid)
 	})
 
+	mux.HandleFunc("/queue/tail/", func(w http.ResponseWriter, r *http.Request) {
+		WebQueueServiceHandleTail(w, r, uid)
+	})
+
+	mux.HandleFunc("/queue/history", func(w http.ResponseWriter, r *http.Request) {
+		WebQueueServiceHandleHistory(w, r, uid)
+	})
+
 	mux.HandleFunc("/queue/download/", func(w http.ResponseWriter, r *http.Request) {
 		WebQueueServiceHandleDownload(w, r, uid)
 	})
@@ -292,6 +418,10 @@ func RunWebQueueService(filename string, uid uint32) (chan bool, error) {
 		WebQueueServiceHandleRelease(w, r, uid)
 	})
 
+	mux.HandleFunc("/queue/retry/", func(w http.ResponseWriter, r *http.Request) {
+		WebQueueServiceHandleRetry(w, r, uid)
+	})
+
 	serv := &http.Server{
 		Handler: mux,
 	}
@@ -25,6 +25,16 @@ func (x *CommandWipe) removeRepositoryConfig(opts *Options, distro *Distribution
 					append(distrocfg.Architectures[:i],
 						distrocfg.Architectures[i+1:]...)
 
+				for j, cross := range distrocfg.CrossArchitectures {
+					if cross == arch {
+						distrocfg.CrossArchitectures =
+							append(distrocfg.CrossArchitectures[:j],
+								distrocfg.CrossArchitectures[j+1:]...)
+
+						break
+					}
+				}
+
 				if len(distrocfg.Architectures) == 0 {
 					opts.BuildOptions.Distributions =
 						append(opts.BuildOptions.Distributions[:ic],
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type buildJob struct {
+	Build        *BuildInfo
+	Distribution *Distribution
+	Arch         string
+
+	// The source build of this distribution, for binary builds
+	Source     *DistroBuildInfo
+	BuildIndep bool
+}
+
+func (x *buildJob) IsSource() bool {
+	return x.Arch == "source"
+}
+
+func (x *buildJob) limitKeys() []string {
+	if x.IsSource() {
+		return []string{x.Distribution.SourceName()}
+	}
+
+	return []string{
+		x.Distribution.SourceName(),
+		x.Distribution.BinaryName(x.Arch),
+	}
+}
+
+func (x *BuilderOptions) maxBuilds() int {
+	if x.MaxBuilds <= 0 {
+		return 1
+	}
+
+	return x.MaxBuilds
+}
+
+func (x *PackageBuilder) canStart(keys []string) bool {
+	if x.running >= options.Builder.maxBuilds() {
+		return false
+	}
+
+	for _, key := range keys {
+		limit, ok := options.Builder.Limits[key]
+
+		if ok && limit > 0 && x.runningLimits[key] >= limit {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (x *PackageBuilder) acquire(keys []string) {
+	x.running++
+
+	for _, key := range keys {
+		x.runningLimits[key]++
+	}
+}
+
+func (x *PackageBuilder) release(keys []string) {
+	x.running--
+
+	for _, key := range keys {
+		x.runningLimits[key]--
+	}
+}
+
+func (x *PackageBuilder) schedule() {
+	// First run jobs of packages which are already building
+	jobs := make([]*buildJob, 0, len(x.jobs))
+
+	for _, job := range x.jobs {
+		keys := job.limitKeys()
+
+		if x.waitingForIndep(job) {
+			jobs = append(jobs, job)
+		} else if x.canStart(keys) {
+			x.acquire(keys)
+			go x.runJob(job)
+		} else {
+			jobs = append(jobs, job)
+		}
+	}
+
+	x.jobs = jobs
+
+	// Then start new packages while there are workers left
+	for len(x.PackageQueue) > 0 && x.canStart(nil) {
+		i := x.nextQueued(x.PackageQueue, x.served)
+
+		if i == -1 {
+			break
+		}
+
+		info := x.PackageQueue[i]
+
+		x.PackageQueue = append(x.PackageQueue[:i], x.PackageQueue[i+1:]...)
+
+		x.servedCount++
+		x.served[info.Uid] = x.servedCount
+
+		x.startPackage(info)
+	}
+}
+
+func (x *PackageBuilder) startPackage(info *PackageInfo) {
+	if options.Verbose {
+		fmt.Printf("Building package %v (%v): %v\n", info.StageFile, info.Name, info.Version)
+	}
+
+	binfo := x.resumable[info.Id]
+
+	if binfo != nil {
+		// Only the steps which did not finish before the restart are
+		// built again
+		delete(x.resumable, info.Id)
+
+		if options.Verbose {
+			fmt.Printf("Resuming build of `%s' (%v steps finished)\n", path.Base(info.StageFile), len(binfo.Packages))
+		}
+	} else {
+		binfo = &BuildInfo{
+			Info:     info,
+			Packages: make(map[uint64]*DistroBuildInfo),
+			Started:  time.Now(),
+		}
+	}
+
+	// Extracting the package counts as pending work
+	binfo.pending = 1
+
+	x.CurrentlyBuilding[info.Id] = info
+	x.building[info.Id] = binfo
+
+	// Extracting the package takes up a worker
+	x.acquire(nil)
+	go x.preparePackage(binfo)
+}
+
+func (x *PackageBuilder) preparePackage(binfo *BuildInfo) {
+	var pack *ExtractedPackage
+
+	err := runCapturedHooks(HookPreExtract, binfo, nil)
+
+	if err == nil {
+		pack, err = x.extractPackage(binfo)
+	}
+
+	if err == nil {
+		buildresult := path.Join(pack.Dir, "result")
+
+		os.RemoveAll(buildresult)
+		os.MkdirAll(buildresult, 0755)
+
+		binfo.BuildResultsDir = buildresult
+		binfo.Package = pack
+	}
+
+	x.Do(func(b *PackageBuilder) error {
+		b.release(nil)
+		binfo.pending--
+
+		if err != nil {
+			// Extracting fails when the build is cancelled, which is
+			// recorded as cancelled rather than failed
+			if !binfo.cancelled {
+				binfo.Error = WrapError(err)
+			}
+		} else if !binfo.cancelled {
+			for _, distro := range pack.Options.Distributions {
+				src := binfo.finishedStep(distro, "source")
+
+				if src == nil {
+					b.jobs = append(b.jobs, &buildJob{
+						Build:        binfo,
+						Distribution: distro,
+						Arch:         "source",
+					})
+
+					binfo.pending++
+				} else if src.Error == nil && len(src.Published) == 0 {
+					b.queueBinaryJobs(binfo, distro, src)
+				}
+			}
+		}
+
+		if binfo.pending == 0 {
+			b.finishPackage(binfo)
+		}
+
+		b.notify()
+		return nil
+	})
+}
+
+func (x *PackageBuilder) runJob(job *buildJob) {
+	var res *DistroBuildInfo
+
+	if job.IsSource() {
+		res = x.buildSourcePackage(job.Build, job.Distribution)
+	} else {
+		res = x.buildBinaryPackages(job.Build, job.Source, job.Distribution, job.Arch, job.BuildIndep)
+	}
+
+	x.Do(func(b *PackageBuilder) error {
+		b.release(job.limitKeys())
+		b.finishJob(job, res)
+
+		b.notify()
+		return nil
+	})
+}
+
+func (x *PackageBuilder) dropJobs(binfo *BuildInfo) int {
+	jobs := make([]*buildJob, 0, len(x.jobs))
+	dropped := 0
+
+	for _, job := range x.jobs {
+		if job.Build == binfo {
+			dropped++
+		} else {
+			jobs = append(jobs, job)
+		}
+	}
+
+	x.jobs = jobs
+	return dropped
+}
+
+func (x *PackageBuilder) finishJob(job *buildJob, res *DistroBuildInfo) {
+	binfo := job.Build
+
+	delete(binfo.steps, res.Id)
+	res.Finished = time.Now()
+	res.Retries = binfo.Retries[res.Distribution.BinaryName(res.Distribution.Architectures[0])]
+
+	binfo.Packages[res.Id] = res
+	binfo.pending--
+
+	x.journal(&journalEntry{Op: journalStep, Ids: []uint64{binfo.Info.Id}, Step: res})
+	x.recordStep(binfo, res)
+
+	if res.Error != nil {
+		if !binfo.cancelled {
+			binfo.Error = res.Error
+		}
+
+		// Unless the package is built in fail-fast mode, the other
+		// distributions and architectures are still built when a build
+		// fails. Binary packages are only built for distributions of
+		// which the source package was built.
+		if binfo.cancelled {
+			binfo.pending -= x.dropJobs(binfo)
+		} else if binfo.failFast() {
+			x.skipJobs(binfo)
+		}
+	} else if job.IsSource() && !binfo.cancelled && len(res.Published) == 0 {
+		// The binary packages of a source version which is already
+		// published are not built again
+		if binfo.failFast() && binfo.Error != nil {
+			for _, arch := range job.Distribution.Architectures {
+				x.skipStep(binfo, job.Distribution, arch)
+			}
+		} else {
+			x.queueBinaryJobs(binfo, job.Distribution, res)
+		}
+	}
+
+	if binfo.pending == 0 {
+		x.finishPackage(binfo)
+	}
+}
+
+func (x *BuildInfo) failFast() bool {
+	return x.Package != nil && x.Package.Options.FailFast
+}
+
+// skipStep records a build which is not done because another build of the
+// package failed in fail-fast mode.
+func (x *PackageBuilder) skipStep(binfo *BuildInfo, distro *Distribution, arch string) {
+	now := time.Now()
+
+	info := &DistroBuildInfo{
+		IncomingDir: path.Join(options.Base, "incoming", distro.Os, distro.CodeName),
+
+		Distribution: Distribution{
+			Os:            distro.Os,
+			CodeName:      distro.CodeName,
+			Architectures: []string{arch},
+		},
+
+		Error:    ErrBuildSkipped,
+		Id:       atomic.AddUint64(&x.PackageId, 1),
+		Started:  now,
+		Finished: now,
+	}
+
+	binfo.Packages[info.Id] = info
+
+	x.journal(&journalEntry{Op: journalStep, Ids: []uint64{binfo.Info.Id}, Step: info})
+	x.recordStep(binfo, info)
+}
+
+// skipJobs drops the pending jobs of a package and records them as
+// skipped.
+func (x *PackageBuilder) skipJobs(binfo *BuildInfo) {
+	jobs := make([]*buildJob, 0, len(x.jobs))
+
+	for _, job := range x.jobs {
+		if job.Build != binfo {
+			jobs = append(jobs, job)
+			continue
+		}
+
+		binfo.pending--
+
+		if job.IsSource() {
+			// The binary packages of the distribution are not built
+			// either
+			for _, arch := range job.Distribution.Architectures {
+				x.skipStep(binfo, job.Distribution, arch)
+			}
+		}
+
+		x.skipStep(binfo, job.Distribution, job.Arch)
+	}
+
+	x.jobs = jobs
+}
+
+func (x *PackageBuilder) queueBinaryJobs(binfo *BuildInfo, distro *Distribution, src *DistroBuildInfo) {
+	for i, arch := range distro.Architectures {
+		// Skip architectures which were built before a restart
+		if binfo.finishedStep(distro, arch) != nil {
+			continue
+		}
+
+		x.jobs = append(x.jobs, &buildJob{
+			Build:        binfo,
+			Distribution: distro,
+			Arch:         arch,
+			Source:       src,
+
+			// We build binary-indep packages only for the first
+			// architecture supported
+			BuildIndep: i == 0,
+		})
+
+		binfo.pending++
+	}
+}
+
+func (x *PackageBuilder) finishPackage(binfo *BuildInfo) {
+	if binfo.Package != nil {
+		os.RemoveAll(binfo.Package.Dir)
+	}
+
+	// The stage file is kept until the build is complete, so that the
+	// build can be resumed after a restart, or retried when it failed
+	if binfo.Error == nil {
+		binfo.Info.RemoveStageFiles()
+	}
+
+	if options.Verbose {
+		if binfo.Error != nil {
+			fmt.Printf("Error building `%s': %s\n", path.Base(binfo.Info.StageFile), binfo.Error)
+		} else {
+			fmt.Printf("Finished building `%s'\n", path.Base(binfo.Info.StageFile))
+		}
+	}
+
+	binfo.Finished = time.Now()
+
+	delete(x.CurrentlyBuilding, binfo.Info.Id)
+	delete(x.building, binfo.Info.Id)
+
+	x.addFinished(binfo)
+	x.journal(&journalEntry{Op: journalFinish, Build: binfo})
+	x.recordFinished(binfo)
+
+	steps := make([]*DistroBuildInfo, 0, len(binfo.Packages))
+
+	for _, info := range binfo.Packages {
+		steps = append(steps, info)
+	}
+
+	x.notifyUsers(NotifyFinished, binfo, steps)
+	x.autoRelease(binfo)
+}
+
+// retrySteps removes failed steps from a finished package and queues the
+// package again to build them. Steps which finished successfully, or
+// which failed but are not retried, are kept.
+func (x *PackageBuilder) retrySteps(binfo *BuildInfo, steps []*DistroBuildInfo) {
+	for i, res := range x.FinishedPackages {
+		if res == binfo {
+			x.FinishedPackages = append(x.FinishedPackages[:i], x.FinishedPackages[i+1:]...)
+			break
+		}
+	}
+
+	if binfo.Retries == nil {
+		binfo.Retries = make(map[string]int)
+	}
+
+	for _, info := range steps {
+		delete(binfo.Packages, info.Id)
+		delete(x.BuildInfoMap, info.Id)
+		binfo.Retries[info.Distribution.BinaryName(info.Distribution.Architectures[0])]++
+	}
+
+	for _, info := range binfo.Packages {
+		delete(x.BuildInfoMap, info.Id)
+	}
+
+	binfo.Error = nil
+	binfo.cancelled = false
+
+	for _, info := range binfo.Packages {
+		if info.Error != nil {
+			binfo.Error = info.Error
+		}
+	}
+
+	// The package is resumed like a package which was interrupted by a
+	// restart, building only the steps which are not in Packages
+	x.resumable[binfo.Info.Id] = binfo
+	x.PackageQueue = append(x.PackageQueue, binfo.Info)
+}
+
+// Retry builds the failed build steps with the given ids again.
+func (x *PackageBuilder) Retry(ids []uint64, uid uint32) ([]uint64, error) {
+	retval := make([]uint64, 0, len(ids))
+
+	return retval, x.Do(func(b *PackageBuilder) error {
+		retry := make(map[*BuildInfo][]*DistroBuildInfo)
+
+		for _, id := range ids {
+			binfo, info := b.FindPackage(id)
+
+			if info == nil {
+				return fmt.Errorf("There is no finished build with id %v", id)
+			}
+
+			if binfo.Info.Uid != uid {
+				return fmt.Errorf("The package `%s' is not owned by you", path.Base(binfo.Info.StageFile))
+			}
+
+			if info.Error == nil {
+				return fmt.Errorf("The build %v of `%s' did not fail", id, path.Base(binfo.Info.StageFile))
+			}
+
+			if _, err := os.Stat(binfo.Info.StageFile); err != nil {
+				return fmt.Errorf("The stage file of `%s' is no longer available, please stage the package again", path.Base(binfo.Info.StageFile))
+			}
+
+			retry[binfo] = append(retry[binfo], info)
+		}
+
+		for binfo, steps := range retry {
+			stepids := make([]uint64, len(steps))
+
+			for i, info := range steps {
+				stepids[i] = info.Id
+			}
+
+			b.retrySteps(binfo, steps)
+			b.journal(&journalEntry{Op: journalRetry, Ids: stepids})
+
+			retval = append(retval, stepids...)
+		}
+
+		b.notify()
+		return nil
+	})
+}
+
+func (x *PackageBuilder) runBuildCommand(binfo *BuildInfo, cmd *exec.Cmd, timeout time.Duration) error {
+	// Run in a separate process group so that the whole process tree
+	// can be terminated when cancelling the build
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := x.Do(func(b *PackageBuilder) error {
+		if binfo.cancelled {
+			return ErrBuildCancelled
+		}
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		if binfo.commands == nil {
+			binfo.commands = make(map[*exec.Cmd]bool)
+		}
+
+		binfo.commands[cmd] = true
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	done := false
+	timedout := false
+
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			x.Do(func(b *PackageBuilder) error {
+				if !done {
+					timedout = true
+					KillCommandGroup(cmd, syscall.SIGTERM)
+				}
+
+				return nil
+			})
+
+			// Give pbuilder the chance to clean up after itself
+			time.Sleep(killGracePeriod)
+
+			x.Do(func(b *PackageBuilder) error {
+				if !done {
+					KillCommandGroup(cmd, syscall.SIGKILL)
+				}
+
+				return nil
+			})
+		})
+
+		defer timer.Stop()
+	}
+
+	err = cmd.Wait()
+	cleanup := false
+
+	x.Do(func(b *PackageBuilder) error {
+		done = true
+		delete(binfo.commands, cmd)
+
+		if binfo.cancelled {
+			err = ErrBuildCancelled
+			cleanup = true
+		} else if timedout {
+			err = &TimeoutError{Timeout: timeout}
+			cleanup = true
+		}
+
+		return nil
+	})
+
+	if cleanup {
+		cleanupBuildPlaces()
+	}
+
+	return err
+}